@@ -2,10 +2,13 @@ package main
 
 import (
 	"api/consts"
+	webhook_models "api/models/webhook"
+	"encoding/json"
 	"os"
 	"time"
 
 	"github.com/kelseyhightower/envconfig"
+	"github.com/nats-io/nats.go"
 	"gopkg.in/yaml.v3"
 )
 
@@ -17,6 +20,11 @@ type Config struct {
 		MaxConcurrentStreams   int           `yaml:"MaxConcurrentStreams" envconfig:"GRPC_MAX_CONCURRENT_STREAMS"`
 		MaxGoriutinesPerStream int           `yaml:"MaxGoriutinesPerStream" envconfig:"GRPC_MAX_GOROUTINES_PER_STREAM"`
 		ConnDeadlineDuration   time.Duration `yaml:"ConnDeadlineDuration" envconfig:"GRPC_CONN_DEADLINE_DURATION"`
+		StreamBatchSize        int           `yaml:"StreamBatchSize" envconfig:"GRPC_STREAM_BATCH_SIZE"`
+		WatchBufferSize        int           `yaml:"WatchBufferSize" envconfig:"GRPC_WATCH_BUFFER_SIZE"`
+		BatchMaxSize           int           `yaml:"BatchMaxSize" envconfig:"GRPC_BATCH_MAX_SIZE"`
+		// return failures in the deprecated status fields instead of the gRPC status
+		LegacyStatus bool `yaml:"LegacyStatus" envconfig:"GRPC_LEGACY_STATUS"`
 	} `yaml:"GRPCSettings"`
 	DBSettings struct {
 		Login    string `yaml:"Login" envconfig:"DB_LOGIN"`
@@ -25,12 +33,65 @@ type Config struct {
 		Port     string `yaml:"Port" envconfig:"DB_PORT"`
 		DB       string `yaml:"DB" envconfig:"DB_DATABASE"`
 		Table    string `yaml:"Table" envconfig:"DB_TABLE"`
+		// table of the change events outbox
+		OutboxTable string `yaml:"OutboxTable" envconfig:"DB_OUTBOX_TABLE"`
+		// table of the change stream resume tokens
+		ResumeTokensTable string `yaml:"ResumeTokensTable" envconfig:"DB_RESUME_TOKENS_TABLE"`
+		// tables of the registered webhooks and the failed deliveries
+		WebhooksTable    string `yaml:"WebhooksTable" envconfig:"DB_WEBHOOKS_TABLE"`
+		DeadLettersTable string `yaml:"DeadLettersTable" envconfig:"DB_DEAD_LETTERS_TABLE"`
+		// default timeouts of one store operation
+		ReadTimeout  time.Duration `yaml:"ReadTimeout" envconfig:"DB_READ_TIMEOUT"`
+		WriteTimeout time.Duration `yaml:"WriteTimeout" envconfig:"DB_WRITE_TIMEOUT"`
+		// deleted users are kept with deleted_at and purged after the retention
+		SoftDelete       bool          `yaml:"SoftDelete" envconfig:"DB_SOFT_DELETE"`
+		DeletedRetention time.Duration `yaml:"DeletedRetention" envconfig:"DB_DELETED_RETENTION"`
+		PurgeInterval    time.Duration `yaml:"PurgeInterval" envconfig:"DB_PURGE_INTERVAL"`
 	} `yaml:"DBSettings"`
 	MetricsSettings struct {
 		Port          string        `yaml:"ServerPort" envconfig:"METRICS_SERVER_PORT"`
 		ServerRuntime time.Duration `yaml:"ServerRuntime" envconfig:"METRICS_SERVER_RUNTIME"`
 		Path          string        `yaml:"MetricsPath" envconfig:"METRICS_PATH"`
 	} `yaml:"MetricsSettings"`
+	SecuritySettings struct {
+		PasswordHashAlgorithm string `yaml:"PasswordHashAlgorithm" envconfig:"PASSWORD_HASH_ALGORITHM"`
+	} `yaml:"SecuritySettings"`
+	WatcherSettings struct {
+		BufferSize     int           `yaml:"BufferSize" envconfig:"WATCHER_BUFFER_SIZE"`
+		OverflowPolicy string        `yaml:"OverflowPolicy" envconfig:"WATCHER_OVERFLOW_POLICY"`
+		SpillPath      string        `yaml:"SpillPath" envconfig:"WATCHER_SPILL_PATH"`
+		PushTimeout    time.Duration `yaml:"PushTimeout" envconfig:"WATCHER_PUSH_TIMEOUT"`
+		// pubsub, nats or kafka
+		Backend string `yaml:"Backend" envconfig:"WATCHER_BACKEND"`
+		// rpc, outbox or change-stream
+		EventSource        string        `yaml:"EventSource" envconfig:"WATCHER_EVENT_SOURCE"`
+		OutboxPollInterval time.Duration `yaml:"OutboxPollInterval" envconfig:"WATCHER_OUTBOX_POLL_INTERVAL"`
+		OutboxMaxAttempts  int           `yaml:"OutboxMaxAttempts" envconfig:"WATCHER_OUTBOX_MAX_ATTEMPTS"`
+	} `yaml:"WatcherSettings"`
+	PubSubSettings struct {
+		ProjectID       string `yaml:"ProjectID" envconfig:"PUBSUB_PROJECT_ID"`
+		Topic           string `yaml:"Topic" envconfig:"PUBSUB_TOPIC"`
+		CredentialsPath string `yaml:"CredentialsPath" envconfig:"PUBSUB_CREDENTIALS_PATH"`
+	} `yaml:"PubSubSettings"`
+	NatsSettings struct {
+		URL     string `yaml:"URL" envconfig:"NATS_URL"`
+		Stream  string `yaml:"Stream" envconfig:"NATS_STREAM"`
+		Subject string `yaml:"Subject" envconfig:"NATS_SUBJECT"`
+	} `yaml:"NatsSettings"`
+	KafkaSettings struct {
+		Brokers []string `yaml:"Brokers" envconfig:"KAFKA_BROKERS"`
+		Topic   string   `yaml:"Topic" envconfig:"KAFKA_TOPIC"`
+	} `yaml:"KafkaSettings"`
+	WebhookSettings struct {
+		// the env value is the JSON list of the webhooks
+		Endpoints   WebhookEndpoints `yaml:"Endpoints" envconfig:"WEBHOOK_ENDPOINTS"`
+		Timeout     time.Duration    `yaml:"Timeout" envconfig:"WEBHOOK_TIMEOUT"`
+		MaxAttempts int              `yaml:"MaxAttempts" envconfig:"WEBHOOK_MAX_ATTEMPTS"`
+		Workers     int              `yaml:"Workers" envconfig:"WEBHOOK_WORKERS"`
+		QueueSize   int              `yaml:"QueueSize" envconfig:"WEBHOOK_QUEUE_SIZE"`
+		// allow the webhooks to the private and the loopback hosts
+		AllowPrivateHosts bool `yaml:"AllowPrivateHosts" envconfig:"WEBHOOK_ALLOW_PRIVATE_HOSTS"`
+	} `yaml:"WebhookSettings"`
 	LogsSettings struct {
 		Prefix    string        `yaml:"Prefix" envconfig:"LOGS_PREFIX"`
 		Frequency time.Duration `yaml:"Frequency" envconfig:"LOGS_FREQUENCY_CREATING"`
@@ -38,6 +99,14 @@ type Config struct {
 	} `yaml:"LogsSettings"`
 }
 
+// Webhooks of the config
+type WebhookEndpoints []*webhook_models.Webhook
+
+// Decode the JSON list of the webhooks from the env
+func (e *WebhookEndpoints) Decode(value string) error {
+	return json.Unmarshal([]byte(value), (*[]*webhook_models.Webhook)(e))
+}
+
 func (c *Config) ReadConfig(path string) error {
 	f, err := os.Open(path)
 	if err != nil {
@@ -76,6 +145,100 @@ func (c *Config) SetDefaultConsts() {
 	if c.GRPCSettings.ConnDeadlineDuration == 0 {
 		c.GRPCSettings.ConnDeadlineDuration = consts.GRPC_CONN_DEADLINE_DURATION
 	}
+	if c.GRPCSettings.StreamBatchSize == 0 {
+		c.GRPCSettings.StreamBatchSize = consts.GRPC_STREAM_BATCH_SIZE
+	}
+	if c.GRPCSettings.BatchMaxSize == 0 {
+		c.GRPCSettings.BatchMaxSize = consts.GRPC_BATCH_MAX_SIZE
+	}
+	if c.GRPCSettings.WatchBufferSize == 0 {
+		c.GRPCSettings.WatchBufferSize = consts.WATCH_BUFFER_SIZE
+	}
+
+	// security
+	if c.SecuritySettings.PasswordHashAlgorithm == "" {
+		c.SecuritySettings.PasswordHashAlgorithm = consts.PASSWORD_HASH_ALGORITHM
+	}
+
+	// watcher
+	if c.WatcherSettings.BufferSize == 0 {
+		c.WatcherSettings.BufferSize = consts.WATCHER_BUFFER_SIZE
+	}
+	if c.WatcherSettings.OverflowPolicy == "" {
+		c.WatcherSettings.OverflowPolicy = consts.WATCHER_OVERFLOW_POLICY
+	}
+	if c.WatcherSettings.SpillPath == "" {
+		c.WatcherSettings.SpillPath = consts.WATCHER_SPILL_PATH
+	}
+	if c.WatcherSettings.PushTimeout == 0 {
+		c.WatcherSettings.PushTimeout = consts.WATCHER_PUSH_TIMEOUT
+	}
+	if c.WatcherSettings.Backend == "" {
+		c.WatcherSettings.Backend = consts.WATCHER_BACKEND
+	}
+	if c.WatcherSettings.EventSource == "" {
+		c.WatcherSettings.EventSource = consts.WATCHER_EVENT_SOURCE
+	}
+	if c.WatcherSettings.OutboxPollInterval == 0 {
+		c.WatcherSettings.OutboxPollInterval = consts.OUTBOX_POLL_INTERVAL
+	}
+	if c.WatcherSettings.OutboxMaxAttempts == 0 {
+		c.WatcherSettings.OutboxMaxAttempts = consts.OUTBOX_MAX_ATTEMPTS
+	}
+
+	// watcher backends
+	if c.NatsSettings.URL == "" {
+		c.NatsSettings.URL = nats.DefaultURL
+	}
+	if c.NatsSettings.Stream == "" {
+		c.NatsSettings.Stream = consts.NATS_STREAM
+	}
+	if c.NatsSettings.Subject == "" {
+		c.NatsSettings.Subject = consts.NATS_SUBJECT
+	}
+	if c.KafkaSettings.Topic == "" {
+		c.KafkaSettings.Topic = consts.KAFKA_TOPIC
+	}
+
+	// webhooks
+	if c.WebhookSettings.Timeout == 0 {
+		c.WebhookSettings.Timeout = consts.WEBHOOK_TIMEOUT
+	}
+	if c.WebhookSettings.MaxAttempts == 0 {
+		c.WebhookSettings.MaxAttempts = consts.WEBHOOK_MAX_ATTEMPTS
+	}
+	if c.WebhookSettings.Workers == 0 {
+		c.WebhookSettings.Workers = consts.WEBHOOK_WORKERS
+	}
+	if c.WebhookSettings.QueueSize == 0 {
+		c.WebhookSettings.QueueSize = consts.WEBHOOK_QUEUE_SIZE
+	}
+
+	// db
+	if c.DBSettings.OutboxTable == "" {
+		c.DBSettings.OutboxTable = consts.STORE_OUTBOX_TABLE
+	}
+	if c.DBSettings.ResumeTokensTable == "" {
+		c.DBSettings.ResumeTokensTable = consts.STORE_RESUME_TOKENS_TABLE
+	}
+	if c.DBSettings.WebhooksTable == "" {
+		c.DBSettings.WebhooksTable = consts.STORE_WEBHOOKS_TABLE
+	}
+	if c.DBSettings.DeadLettersTable == "" {
+		c.DBSettings.DeadLettersTable = consts.STORE_DEAD_LETTERS_TABLE
+	}
+	if c.DBSettings.ReadTimeout == 0 {
+		c.DBSettings.ReadTimeout = consts.STORE_READ_TIMEOUT
+	}
+	if c.DBSettings.WriteTimeout == 0 {
+		c.DBSettings.WriteTimeout = consts.STORE_WRITE_TIMEOUT
+	}
+	if c.DBSettings.DeletedRetention == 0 {
+		c.DBSettings.DeletedRetention = consts.STORE_DELETED_RETENTION
+	}
+	if c.DBSettings.PurgeInterval == 0 {
+		c.DBSettings.PurgeInterval = consts.STORE_PURGE_INTERVAL
+	}
 
 	// metrics
 	if c.MetricsSettings.Port == "" {
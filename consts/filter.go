@@ -0,0 +1,6 @@
+package consts
+
+const (
+	FILTER_MAX_DEPTH   int = 5
+	FILTER_MAX_CLAUSES int = 100
+)
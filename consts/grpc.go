@@ -7,4 +7,24 @@ const (
 	GRPC_MAX_CONCURRENT_STREAMS    int           = 10
 	GRPC_MAX_GOROUTINES_PER_STREAM int           = 30
 	GRPC_CONN_DEADLINE_DURATION    time.Duration = 5 * time.Minute
+	GRPC_STREAM_BATCH_SIZE         int           = 100
+	// max number of users changed by one batch request
+	GRPC_BATCH_MAX_SIZE int = 1000
+)
+
+// Domain of the ErrorInfo details
+const GRPC_ERROR_DOMAIN string = "users-api"
+
+// Reasons of the ErrorInfo details
+const (
+	GRPC_REASON_INVALID_REQUEST   string = "INVALID_REQUEST"
+	GRPC_REASON_INVALID_FIELDS    string = "INVALID_FIELDS"
+	GRPC_REASON_NOT_FOUND         string = "NOT_FOUND"
+	GRPC_REASON_CONFLICT          string = "CONFLICT"
+	GRPC_REASON_VERSION_MISMATCH  string = "VERSION_MISMATCH"
+	GRPC_REASON_SKIPPED           string = "SKIPPED"
+	GRPC_REASON_READ_ONLY         string = "READ_ONLY"
+	GRPC_REASON_STORE_UNAVAILABLE string = "STORE_UNAVAILABLE"
+	GRPC_REASON_WATCH_CLOSED      string = "WATCH_CLOSED"
+	GRPC_REASON_INTERNAL          string = "INTERNAL"
 )
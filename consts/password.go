@@ -0,0 +1,28 @@
+package consts
+
+const (
+	PASSWORD_HASH_BCRYPT   string = "bcrypt"
+	PASSWORD_HASH_ARGON2ID string = "argon2id"
+
+	PASSWORD_HASH_ALGORITHM string = PASSWORD_HASH_BCRYPT
+	PASSWORD_BCRYPT_COST    int    = 12
+
+	PASSWORD_ARGON2_TIME    uint32 = 1
+	PASSWORD_ARGON2_MEMORY  uint32 = 64 * 1024
+	PASSWORD_ARGON2_THREADS uint8  = 4
+	PASSWORD_ARGON2_KEY_LEN uint32 = 32
+	PASSWORD_ARGON2_SALT    int    = 16
+)
+
+// Bounds of the argon2id parameters of the stored hashes,
+// the memory is in KiB
+const (
+	PASSWORD_ARGON2_MAX_TIME    uint32 = 10
+	PASSWORD_ARGON2_MIN_MEMORY  uint32 = 8 * 1024
+	PASSWORD_ARGON2_MAX_MEMORY  uint32 = 256 * 1024
+	PASSWORD_ARGON2_MAX_THREADS uint8  = 16
+	PASSWORD_ARGON2_MIN_KEY_LEN int    = 16
+	PASSWORD_ARGON2_MAX_KEY_LEN int    = 64
+	PASSWORD_ARGON2_MIN_SALT    int    = 8
+	PASSWORD_ARGON2_MAX_SALT    int    = 64
+)
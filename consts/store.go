@@ -1,8 +1,37 @@
 package consts
 
+import "time"
+
 const (
 	STORE_ERROR_FAILURE string = "store response failure: %v"
 	STORE_KEY_NOT_FOUND string = "store key not found error: %v"
 	STORE_ID_NOT_SET    string = "store id not set error: %v"
 	STORE_BAD_REQUEST   string = "store bad request error: %v"
+	STORE_CONFLICT      string = "store conflict error: %v"
+	STORE_VERSION       string = "store version mismatch error: %v"
+)
+
+const STORE_OUTBOX_TABLE string = "outbox"
+
+const STORE_RESUME_TOKENS_TABLE string = "resume_tokens"
+
+// Default timeouts of one store operation
+const (
+	STORE_READ_TIMEOUT  time.Duration = 30 * time.Second
+	STORE_WRITE_TIMEOUT time.Duration = 10 * time.Second
+	// the cursor of the cancelled request is closed with this timeout
+	STORE_CURSOR_CLOSE_TIMEOUT time.Duration = 5 * time.Second
+)
+
+// Soft deleted users
+const (
+	// the deleted users are purged after this period
+	STORE_DELETED_RETENTION time.Duration = 30 * 24 * time.Hour
+	// how often the expired deleted users are purged
+	STORE_PURGE_INTERVAL time.Duration = time.Hour
+)
+
+const (
+	STORE_WEBHOOKS_TABLE     string = "webhooks"
+	STORE_DEAD_LETTERS_TABLE string = "webhook_dead_letters"
 )
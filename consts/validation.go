@@ -0,0 +1,11 @@
+package consts
+
+const (
+	VALIDATION_NAME_MAX_LEN        int = 100
+	VALIDATION_NICKNAME_MIN_LEN    int = 3
+	VALIDATION_NICKNAME_MAX_LEN    int = 32
+	VALIDATION_EMAIL_MAX_LEN       int = 254
+	VALIDATION_EMAIL_LOCAL_MAX_LEN int = 64
+	VALIDATION_PASSWORD_MIN_LEN    int = 8
+	VALIDATION_PASSWORD_MAX_LEN    int = 72
+)
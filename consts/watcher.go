@@ -0,0 +1,61 @@
+package consts
+
+import "time"
+
+const (
+	WATCHER_CLOSE_TIMEOUT   time.Duration = 30 * time.Second
+	WATCHER_PUBLISH_TIMEOUT time.Duration = 10 * time.Second
+	// backoff of the failed publishing
+	WATCHER_RETRY_MIN_DELAY time.Duration = time.Second
+	WATCHER_RETRY_MAX_DELAY time.Duration = 5 * time.Minute
+	// failed events which keep the acks of the publishers
+	WATCHER_MAX_FAILED_EVENTS int = 10000
+)
+
+const (
+	WATCHER_BUFFER_SIZE     int    = 1000
+	WATCHER_OVERFLOW_POLICY string = "drop-oldest"
+	WATCHER_SPILL_PATH      string = "watcher-spill.jsonl"
+	// max wait of the request for the full queue by the block policy
+	WATCHER_PUSH_TIMEOUT time.Duration = time.Second
+)
+
+const (
+	OUTBOX_POLL_INTERVAL time.Duration = time.Second
+	OUTBOX_LEASE         time.Duration = 30 * time.Second
+	// the entry is dead after the failed attempts, about 4 hours with the backoff
+	OUTBOX_MAX_ATTEMPTS int = 50
+	// delivered entries are removed by the TTL index
+	OUTBOX_DELIVERED_TTL time.Duration = 7 * 24 * time.Hour
+)
+
+const (
+	WATCHER_EVENT_SOURCE string = "rpc"
+	// delay before the broken change stream is opened again
+	WATCHER_REOPEN_DELAY time.Duration = 5 * time.Second
+)
+
+const (
+	WATCHER_BACKEND string = "pubsub"
+	NATS_STREAM     string = "USERS"
+	NATS_SUBJECT    string = "users.events"
+	KAFKA_TOPIC     string = "users.events"
+	// max wait of the kafka writer for the batch
+	KAFKA_BATCH_TIMEOUT time.Duration = 10 * time.Millisecond
+)
+
+const (
+	WEBHOOK_TIMEOUT         time.Duration = 10 * time.Second
+	WEBHOOK_MAX_ATTEMPTS    int           = 8
+	WEBHOOK_RELOAD_INTERVAL time.Duration = 30 * time.Second
+	WEBHOOK_SECRET_MIN_LEN  int           = 16
+	WEBHOOK_WORKERS         int           = 8
+	WEBHOOK_QUEUE_SIZE      int           = 1000
+	// the finished delivery waits for the ack of the event published again
+	WEBHOOK_ACK_TTL time.Duration = time.Hour
+	// max size of the response body read from the endpoint
+	WEBHOOK_MAX_RESPONSE_SIZE int64 = 64 << 10
+)
+
+// events buffered for one WatchUsers stream
+const WATCH_BUFFER_SIZE int = 100
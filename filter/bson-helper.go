@@ -1,19 +1,74 @@
 package filter
 
-import "go.mongodb.org/mongo-driver/bson"
+import (
+	"api/consts"
+	filter_models "api/models/filter"
+	store_models "api/models/store"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Fields of the user which can be used to filter and sort
+var userFields = map[string]string{
+	"id":         "_id",
+	"first_name": "first_name",
+	"last_name":  "last_name",
+	"nickname":   "nickname",
+	"email":      "email",
+	"country":    "country",
+	"created_at": "created_at",
+	"updated_at": "updated_at",
+}
+
+// Date fields of the user, the old documents keep them as the strings
+var dateFields = map[string]bool{
+	"created_at": true,
+	"updated_at": true,
+}
+
+// Fields of the user which can be only read
+var readOnlyUserFields = map[string]string{
+	"version":    "version",
+	"deleted_at": "deleted_at",
+}
 
 type BsonHelper struct {
+	// max depth of the filter expression,
+	// FILTER_MAX_DEPTH is used by default
+	MaxDepth int
+	// max number of clauses in the filter,
+	// FILTER_MAX_CLAUSES is used by default
+	MaxClauses int
 }
 
-func (f *BsonHelper) Filter(
-	filters map[string][]interface{}) interface{} {
+// The content of the opaque page token
+type pageToken struct {
+	// sort of the pages, the token is valid only for the same sort
+	Sort []string `bson:"sort"`
+	// sort keys of the last document on the previous page,
+	// the last key is the _id
+	Values bson.A `bson:"values"`
+	// the keys which the last document doesn't have or which are null
+	Missing []bool `bson:"missing,omitempty"`
+}
 
-	if filters == nil {
-		return nil
-	}
+/*
+Create the bson filter from the input.
+All parts of the input are joined with $and.
+The date ranges also match the dates of the old documents kept as the strings.
+The expression is converted to the nested $and, $or and $nor.
+Prefix conditions use the anchored case sensitive regex, so they can use the index.
+Suffix and contains conditions have to scan the values.
+*/
+func (f *BsonHelper) Filter(input filter_models.Input) (interface{}, error) {
 
 	m := []bson.D{}
-	for key, values := range filters {
+	for key, values := range input.In {
 		if len(values) == 0 {
 			continue
 		}
@@ -21,9 +76,435 @@ func (f *BsonHelper) Filter(
 		for _, v := range values {
 			vals = append(vals, v)
 		}
-		m = append(m, bson.D{{key,
-			bson.D{{"$in", vals}},
+		m = append(m, bson.D{{Key: key,
+			Value: bson.D{{Key: "$in", Value: vals}},
 		}})
 	}
-	return bson.M{"$and": m}
+	for _, r := range input.Ranges {
+		cond, legacy := bson.D{}, bson.D{}
+		if !r.From.IsZero() {
+			cond = append(cond, bson.E{Key: "$gte", Value: r.From})
+			legacy = append(legacy, bson.E{Key: "$gte", Value: legacyDate(r.From)})
+		}
+		if !r.To.IsZero() {
+			cond = append(cond, bson.E{Key: "$lt", Value: r.To})
+			legacy = append(legacy, bson.E{Key: "$lt", Value: legacyDate(r.To)})
+		}
+		if len(cond) == 0 {
+			continue
+		}
+		m = append(m, bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: r.Field, Value: cond}},
+			bson.D{{Key: r.Field, Value: legacy}},
+		}}})
+	}
+	for _, c := range input.Conditions {
+		cond, err := condition(c)
+		if err != nil {
+			return nil, err
+		}
+		m = append(m, cond)
+	}
+	if input.Expression != nil {
+		clauses := len(m)
+		expr, err := f.expression(input.Expression, 1, &clauses)
+		if err != nil {
+			return nil, err
+		}
+		m = append(m, expr)
+	}
+	if len(m) > f.maxClauses() {
+		return nil, fmt.Errorf("the filter has more than %d clauses", f.maxClauses())
+	}
+	// $and must be a nonempty array
+	if len(m) == 0 {
+		return bson.D{}, nil
+	}
+	return bson.M{"$and": m}, nil
+}
+
+/*
+Create the query for one page of the sorted and filtered documents.
+Pages are keyed on the sort keys and _id: the token keeps the keys
+of the last document of the previous page, so the next page starts right after it.
+One extra document is requested to know if the next page exists.
+The zero size without the token means no pagination.
+*/
+func (f *BsonHelper) Page(filter interface{}, sort []filter_models.SortField,
+	size int32, token string) (*store_models.Query, error) {
+
+	if size < 0 {
+		return nil, fmt.Errorf("page_size must not be negative")
+	}
+	query := &store_models.Query{Filter: filter}
+
+	// convert the sort
+	sortDoc, err := bsonSort(sort)
+	if err != nil {
+		return nil, err
+	}
+	if len(sort) != 0 {
+		query.Sort = sortDoc
+	}
+	if size == 0 && token == "" {
+		return query, nil
+	}
+	// pages need the stable order
+	query.Sort = sortDoc
+	if size > 0 {
+		query.Limit = int64(size) + 1
+	}
+	if token == "" {
+		return query, nil
+	}
+
+	// decode the token
+	pt, err := decodePageToken(token)
+	if err != nil {
+		return nil, err
+	}
+	after, err := afterCondition(sortDoc, pt)
+	if err != nil {
+		return nil, err
+	}
+	// add the range condition
+	if filter == nil {
+		query.Filter = after
+	} else {
+		query.Filter = bson.M{"$and": bson.A{filter, after}}
+	}
+	return query, nil
+}
+
+// Create the token of the page which follows the document
+func (f *BsonHelper) PageToken(query *store_models.Query,
+	last store_models.IStoreGetResponse) (string, error) {
+
+	sortDoc, ok := query.Sort.(bson.D)
+	if !ok {
+		return "", fmt.Errorf("the query is not sorted")
+	}
+	pt := pageToken{}
+	for _, e := range sortDoc {
+		value, ok := last[e.Key]
+		pt.Sort = append(pt.Sort, fmt.Sprintf("%s:%v", e.Key, e.Value))
+		pt.Values = append(pt.Values, value)
+		pt.Missing = append(pt.Missing, !ok || value == nil)
+	}
+	if last["_id"] == nil {
+		return "", fmt.Errorf("the document has no _id")
+	}
+	b, err := bson.MarshalExtJSON(pt, true, false)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Create the projection returning only the fields.
+// The _id is excluded if the id isn't requested.
+func (f *BsonHelper) Projection(fields []string) (interface{}, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	projection := bson.D{}
+	seen := make(map[string]bool)
+	for _, field := range fields {
+		key, ok := userFields[field]
+		if !ok {
+			key, ok = readOnlyUserFields[field]
+		}
+		if !ok {
+			return nil, fmt.Errorf("reading %q is not allowed", field)
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		projection = append(projection, bson.E{Key: key, Value: 1})
+	}
+	if !seen["_id"] {
+		projection = append(projection, bson.E{Key: "_id", Value: 0})
+	}
+	return projection, nil
+}
+
+// Convert the sort to the bson sort document.
+// The _id is always the last key to make the order stable.
+func bsonSort(sort []filter_models.SortField) (bson.D, error) {
+	sortDoc := bson.D{}
+	seen := make(map[string]bool)
+	for _, s := range sort {
+		key, ok := userFields[s.Field]
+		if !ok {
+			return nil, fmt.Errorf("sorting by %q is not allowed", s.Field)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("sorting by %q is set twice", s.Field)
+		}
+		seen[key] = true
+		direction := 1
+		if s.Desc {
+			direction = -1
+		}
+		sortDoc = append(sortDoc, bson.E{Key: key, Value: direction})
+	}
+	if !seen["_id"] {
+		sortDoc = append(sortDoc, bson.E{Key: "_id", Value: 1})
+	}
+	return sortDoc, nil
+}
+
+/*
+Create the condition for documents which follow the token in the sort order:
+(k1 > v1) OR (k1 = v1 AND k2 > v2) OR ... with $lt for the descending keys.
+The missing key is sorted like null, before all values. The range operators
+don't match null, so the missing keys get their own branches.
+*/
+func afterCondition(sortDoc bson.D, pt *pageToken) (interface{}, error) {
+	if len(pt.Sort) != len(sortDoc) || len(pt.Values) != len(sortDoc) ||
+		(pt.Missing != nil && len(pt.Missing) != len(sortDoc)) {
+		return nil, fmt.Errorf("page_token doesn't match the sort")
+	}
+	for i, e := range sortDoc {
+		if pt.Sort[i] != fmt.Sprintf("%s:%v", e.Key, e.Value) {
+			return nil, fmt.Errorf("page_token doesn't match the sort")
+		}
+	}
+
+	or := bson.A{}
+	for i, e := range sortDoc {
+		// the keys before are equal, null matches the missing key too
+		equal := bson.D{}
+		for j := 0; j < i; j++ {
+			equal = append(equal, bson.E{Key: sortDoc[j].Key, Value: pt.value(j)})
+		}
+		for _, after := range afterKey(e, pt.value(i)) {
+			clause := append(append(bson.D{}, equal...), after)
+			or = append(or, clause)
+		}
+	}
+	if len(or) == 1 {
+		return or[0], nil
+	}
+	return bson.D{{Key: "$or", Value: or}}, nil
+}
+
+/*
+Conditions of the key which follows the value in the sort order.
+The ascending key follows null if it's set.
+The descending key follows the value if it's less or null,
+nothing follows null.
+The string dates of the old documents are sorted before the BSON dates,
+the range operators match only one of the types.
+*/
+func afterKey(e bson.E, value interface{}) []bson.E {
+	desc := e.Value == -1
+	var after []bson.E
+	switch {
+	case value == nil && !desc:
+		return []bson.E{{Key: e.Key, Value: bson.D{{Key: "$ne", Value: nil}}}}
+	case value == nil:
+		return nil
+	case !desc:
+		after = []bson.E{{Key: e.Key, Value: bson.D{{Key: "$gt", Value: value}}}}
+	default:
+		after = []bson.E{
+			{Key: e.Key, Value: bson.D{{Key: "$lt", Value: value}}},
+			{Key: e.Key, Value: nil},
+		}
+	}
+	if !dateFields[e.Key] {
+		return after
+	}
+	_, isString := value.(string)
+	switch {
+	case isString && !desc:
+		after = append(after, bson.E{Key: e.Key,
+			Value: bson.D{{Key: "$type", Value: "date"}}})
+	case !isString && desc:
+		after = append(after, bson.E{Key: e.Key,
+			Value: bson.D{{Key: "$type", Value: "string"}}})
+	}
+	return after
+}
+
+// The key of the last document, nil if it's missing
+func (pt *pageToken) value(i int) interface{} {
+	if pt.Missing != nil && pt.Missing[i] {
+		return nil
+	}
+	return pt.Values[i]
+}
+
+// Convert the expression node to the bson filter.
+// The depth and the number of clauses are checked against the limits.
+func (f *BsonHelper) expression(e *filter_models.Expression,
+	depth int, clauses *int) (bson.D, error) {
+
+	if depth > f.maxDepth() {
+		return nil, fmt.Errorf("the filter expression is deeper than %d", f.maxDepth())
+	}
+	*clauses++
+	if *clauses > f.maxClauses() {
+		return nil, fmt.Errorf("the filter has more than %d clauses", f.maxClauses())
+	}
+
+	switch e.Type {
+	case filter_models.CONDITION:
+		if e.Condition == nil {
+			return nil, fmt.Errorf("the filter condition is empty")
+		}
+		return condition(*e.Condition)
+	case filter_models.NOT:
+		if len(e.Children) != 1 {
+			return nil, fmt.Errorf("the not expression needs one expression")
+		}
+		child, err := f.expression(e.Children[0], depth+1, clauses)
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: "$nor", Value: bson.A{child}}}, nil
+	case filter_models.AND, filter_models.OR:
+		if len(e.Children) == 0 {
+			return nil, fmt.Errorf("the and/or expression needs expressions")
+		}
+		children := bson.A{}
+		for _, c := range e.Children {
+			child, err := f.expression(c, depth+1, clauses)
+			if err != nil {
+				return nil, err
+			}
+			children = append(children, child)
+		}
+		op := "$and"
+		if e.Type == filter_models.OR {
+			op = "$or"
+		}
+		return bson.D{{Key: op, Value: children}}, nil
+	default:
+		return nil, fmt.Errorf("wrong type of the filter expression")
+	}
+}
+
+func (f *BsonHelper) maxDepth() int {
+	if f.MaxDepth <= 0 {
+		return consts.FILTER_MAX_DEPTH
+	}
+	return f.MaxDepth
+}
+
+func (f *BsonHelper) maxClauses() int {
+	if f.MaxClauses <= 0 {
+		return consts.FILTER_MAX_CLAUSES
+	}
+	return f.MaxClauses
+}
+
+// Convert the field condition to the bson filter
+func condition(c filter_models.Condition) (bson.D, error) {
+	key, ok := userFields[c.Field]
+	if !ok {
+		return nil, fmt.Errorf("filter by %q is not allowed", c.Field)
+	}
+
+	var value interface{}
+	switch c.Op {
+	case filter_models.EQ, filter_models.PREFIX,
+		filter_models.SUFFIX, filter_models.CONTAINS:
+		if len(c.Values) != 1 {
+			return nil, fmt.Errorf("filter by %q needs one value", c.Field)
+		}
+	case filter_models.IN, filter_models.NIN:
+		if len(c.Values) == 0 {
+			return nil, fmt.Errorf("filter by %q needs values", c.Field)
+		}
+	case filter_models.EXISTS:
+		if len(c.Values) != 0 {
+			return nil, fmt.Errorf("filter by %q must not have values", c.Field)
+		}
+	default:
+		return nil, fmt.Errorf("wrong operator of the filter by %q", c.Field)
+	}
+
+	if dateFields[key] && c.Op != filter_models.EXISTS {
+		return dateCondition(key, c)
+	}
+
+	switch c.Op {
+	case filter_models.EQ:
+		value = bson.D{{Key: "$eq", Value: c.Values[0]}}
+	case filter_models.IN:
+		value = bson.D{{Key: "$in", Value: bson.A(c.Values)}}
+	case filter_models.NIN:
+		value = bson.D{{Key: "$nin", Value: bson.A(c.Values)}}
+	case filter_models.PREFIX:
+		value = primitive.Regex{Pattern: "^" + quote(c.Values[0])}
+	case filter_models.SUFFIX:
+		value = primitive.Regex{Pattern: quote(c.Values[0]) + "$"}
+	case filter_models.CONTAINS:
+		value = primitive.Regex{Pattern: quote(c.Values[0]), Options: "i"}
+	case filter_models.EXISTS:
+		value = bson.D{{Key: "$exists", Value: c.Exists}}
+	}
+	return bson.D{{Key: key, Value: value}}, nil
+}
+
+/*
+Convert the condition of the date field to the bson filter.
+The values are RFC3339 dates, they match the BSON dates
+and the strings of the old documents like the date ranges.
+The text operators can't match the dates, so they are rejected.
+*/
+func dateCondition(key string, c filter_models.Condition) (bson.D, error) {
+	if c.Op != filter_models.EQ && c.Op != filter_models.IN && c.Op != filter_models.NIN {
+		return nil, fmt.Errorf("filter by %q supports only EQ, IN, NIN and EXISTS", c.Field)
+	}
+	dates, legacy := bson.A{}, bson.A{}
+	for _, v := range c.Values {
+		t, err := time.Parse(consts.TIME_FORMAT, fmt.Sprint(v))
+		if err != nil {
+			return nil, fmt.Errorf("filter by %q needs RFC3339 dates", c.Field)
+		}
+		dates = append(dates, t)
+		// the old documents have no fractions of the second
+		if t.Nanosecond() == 0 {
+			legacy = append(legacy, t.UTC().Format(consts.TIME_FORMAT))
+		}
+	}
+	clauses := bson.A{bson.D{{Key: key, Value: bson.D{{Key: "$in", Value: dates}}}}}
+	if len(legacy) != 0 {
+		clauses = append(clauses, bson.D{{Key: key, Value: bson.D{{Key: "$in", Value: legacy}}}})
+	}
+	if c.Op == filter_models.NIN {
+		return bson.D{{Key: "$nor", Value: clauses}}, nil
+	}
+	return bson.D{{Key: "$or", Value: clauses}}, nil
+}
+
+// Format the bound of the range like the old documents keep the dates.
+// Their dates have no fractions of the second, so the bound is rounded up.
+func legacyDate(t time.Time) string {
+	t = t.UTC()
+	if s := t.Truncate(time.Second); s.Before(t) {
+		t = s.Add(time.Second)
+	}
+	return t.Format(consts.TIME_FORMAT)
+}
+
+// Escape the value to use it in the regex
+func quote(value interface{}) string {
+	return regexp.QuoteMeta(fmt.Sprint(value))
+}
+
+func decodePageToken(token string) (*pageToken, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid page_token")
+	}
+	pt := &pageToken{}
+	if err := bson.UnmarshalExtJSON(b, true, pt); err != nil {
+		return nil, fmt.Errorf("invalid page_token")
+	}
+	return pt, nil
 }
@@ -0,0 +1,411 @@
+package filter
+
+import (
+	"api/consts"
+	filter_models "api/models/filter"
+	store_models "api/models/store"
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Users with the ids u1...u<n>
+func numberedUsers(n int) []bson.M {
+	docs := make([]bson.M, 0, n)
+	for i := 1; i <= n; i++ {
+		docs = append(docs, bson.M{"_id": "u" + string(rune('0'+i)), "first_name": "user"})
+	}
+	return docs
+}
+
+// Join the ids of the pages
+func flatten(pages [][]interface{}) []interface{} {
+	var ids []interface{}
+	for _, page := range pages {
+		ids = append(ids, page...)
+	}
+	return ids
+}
+
+func TestPageQuery(t *testing.T) {
+	f := &BsonHelper{}
+	byID := bson.D{{Key: "_id", Value: 1}}
+	tests := []struct {
+		name      string
+		sort      []filter_models.SortField
+		size      int32
+		wantSort  interface{}
+		wantLimit int64
+		wantErr   bool
+	}{
+		// no pagination keeps the order of the store
+		{name: "no page", wantSort: nil},
+		{name: "sort without page", wantSort: bson.D{{Key: "email", Value: -1},
+			{Key: "_id", Value: 1}},
+			sort: []filter_models.SortField{{Field: "email", Desc: true}}},
+		// one extra document tells if the next page exists
+		{name: "page", size: 10, wantSort: byID, wantLimit: 11},
+		{name: "negative size", size: -1, wantErr: true},
+		{name: "unknown sort field", size: 10, wantErr: true,
+			sort: []filter_models.SortField{{Field: "password"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := f.Page(bson.D{}, tt.sort, tt.size, "")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Page error = nil, want the error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Page error: %v", err)
+			}
+			if !reflect.DeepEqual(query.Sort, tt.wantSort) {
+				t.Errorf("sort = %v, want %v", query.Sort, tt.wantSort)
+			}
+			if query.Limit != tt.wantLimit {
+				t.Errorf("limit = %d, want %d", query.Limit, tt.wantLimit)
+			}
+		})
+	}
+}
+
+func TestPagesReadAllUsers(t *testing.T) {
+	f := &BsonHelper{}
+	docs := numberedUsers(7)
+	want := []interface{}{"u1", "u2", "u3", "u4", "u5", "u6", "u7"}
+	for size := int32(1); size <= 8; size++ {
+		pages := readPages(t, f, docs, bson.D{}, nil, size)
+		if got := flatten(pages); !reflect.DeepEqual(got, want) {
+			t.Errorf("size %d: users = %v, want %v", size, got, want)
+		}
+		for i, page := range pages[:len(pages)-1] {
+			if len(page) != int(size) {
+				t.Errorf("size %d: page %d has %d users", size, i, len(page))
+			}
+		}
+	}
+	// the filter is kept on the next pages
+	filter, err := f.Filter(filter_models.Input{
+		In: map[string][]interface{}{"_id": {"u2", "u3", "u5"}},
+	})
+	if err != nil {
+		t.Fatalf("Filter error: %v", err)
+	}
+	pages := readPages(t, f, docs, filter, nil, 1)
+	if got := flatten(pages); !reflect.DeepEqual(got, []interface{}{"u2", "u3", "u5"}) {
+		t.Errorf("filtered users = %v, want [u2 u3 u5]", got)
+	}
+}
+
+func TestPageInvalidToken(t *testing.T) {
+	f := &BsonHelper{}
+	byEmail := []filter_models.SortField{{Field: "email"}}
+	query, err := f.Page(nil, byEmail, 2, "")
+	if err != nil {
+		t.Fatalf("Page error: %v", err)
+	}
+	token, err := f.PageToken(query, store_models.IStoreGetResponse{
+		"_id": "u1", "email": "ex@vv.com"})
+	if err != nil {
+		t.Fatalf("PageToken error: %v", err)
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		t.Fatalf("the token isn't base64: %v", err)
+	}
+	// the token of the other sort with the valid encoding
+	forged := base64.RawURLEncoding.EncodeToString(
+		[]byte(strings.Replace(string(raw), `"email:1"`, `"nickname:1"`, 1)))
+
+	tests := []struct {
+		name  string
+		sort  []filter_models.SortField
+		token string
+	}{
+		{name: "not base64", sort: byEmail, token: "not a token!"},
+		{name: "tampered bytes", sort: byEmail,
+			token: base64.RawURLEncoding.EncodeToString(append(raw[:len(raw)-2], '!'))},
+		{name: "not the token document", sort: byEmail,
+			token: base64.RawURLEncoding.EncodeToString([]byte(`{"sort": 1}`))},
+		{name: "sort changed between pages", token: token,
+			sort: []filter_models.SortField{{Field: "email", Desc: true}}},
+		{name: "sort field added", token: token,
+			sort: []filter_models.SortField{{Field: "email"}, {Field: "nickname"}}},
+		{name: "sort of the token changed", sort: byEmail, token: forged},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := f.Page(nil, tt.sort, 2, tt.token); err == nil {
+				t.Error("Page error = nil, want the invalid token")
+			}
+		})
+	}
+	if _, err := f.Page(nil, byEmail, 2, token); err != nil {
+		t.Errorf("Page with the valid token error: %v", err)
+	}
+}
+
+func TestPageTokenWithoutSort(t *testing.T) {
+	f := &BsonHelper{}
+	// the query without the page isn't sorted
+	query, err := f.Page(nil, nil, 0, "")
+	if err != nil {
+		t.Fatalf("Page error: %v", err)
+	}
+	if _, err := f.PageToken(query, store_models.IStoreGetResponse{"_id": "u1"}); err == nil {
+		t.Error("PageToken error = nil, want the unsorted query")
+	}
+	query, err = f.Page(nil, nil, 1, "")
+	if err != nil {
+		t.Fatalf("Page error: %v", err)
+	}
+	if _, err := f.PageToken(query, store_models.IStoreGetResponse{}); err == nil {
+		t.Error("PageToken error = nil, want the missing _id")
+	}
+}
+
+func TestPagesSortNullKeys(t *testing.T) {
+	f := &BsonHelper{}
+	// the users of the old versions have no nickname or the null one
+	docs := []bson.M{
+		{"_id": "u1", "nickname": "bob", "country": "UK"},
+		{"_id": "u2", "country": "DE"},
+		{"_id": "u3", "nickname": nil, "country": "UK"},
+		{"_id": "u4", "nickname": "alice"},
+		{"_id": "u5", "nickname": "bob", "country": "DE"},
+		{"_id": "u6"},
+		{"_id": "u7", "nickname": "carol", "country": "UK"},
+	}
+	tests := []struct {
+		name string
+		sort []filter_models.SortField
+		want []interface{}
+	}{
+		// null and the missing field are before the strings, the ties are sorted by _id
+		{name: "asc", sort: []filter_models.SortField{{Field: "nickname"}},
+			want: []interface{}{"u2", "u3", "u6", "u4", "u1", "u5", "u7"}},
+		{name: "desc", sort: []filter_models.SortField{{Field: "nickname", Desc: true}},
+			want: []interface{}{"u7", "u1", "u5", "u4", "u2", "u3", "u6"}},
+		{name: "two null keys", sort: []filter_models.SortField{
+			{Field: "country", Desc: true}, {Field: "nickname"}},
+			want: []interface{}{"u3", "u1", "u7", "u2", "u5", "u6", "u4"}},
+		{name: "two null keys asc", sort: []filter_models.SortField{
+			{Field: "country"}, {Field: "nickname", Desc: true}},
+			want: []interface{}{"u4", "u6", "u5", "u2", "u7", "u1", "u3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := f.Page(nil, tt.sort, 0, "")
+			if err != nil {
+				t.Fatalf("Page error: %v", err)
+			}
+			var sorted []interface{}
+			for _, doc := range runQuery(t, query, docs) {
+				sorted = append(sorted, doc["_id"])
+			}
+			if !reflect.DeepEqual(sorted, tt.want) {
+				t.Fatalf("sorted users = %v, want %v", sorted, tt.want)
+			}
+			// every user is on one page in the order of the sort
+			for size := int32(1); size <= int32(len(docs)); size++ {
+				got := flatten(readPages(t, f, docs, nil, tt.sort, size))
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("size %d: users = %v, want %v", size, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPageSortFields(t *testing.T) {
+	f := &BsonHelper{}
+	tests := []struct {
+		name    string
+		sort    []filter_models.SortField
+		want    bson.D
+		wantErr bool
+	}{
+		{name: "id", sort: []filter_models.SortField{{Field: "id", Desc: true}},
+			want: bson.D{{Key: "_id", Value: -1}}},
+		{name: "date", sort: []filter_models.SortField{{Field: "created_at", Desc: true}},
+			want: bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: 1}}},
+		{name: "duplicate field", wantErr: true,
+			sort: []filter_models.SortField{{Field: "email"}, {Field: "email", Desc: true}}},
+		{name: "hidden field", wantErr: true,
+			sort: []filter_models.SortField{{Field: "password"}}},
+		{name: "empty field", wantErr: true, sort: []filter_models.SortField{{}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := f.Page(nil, tt.sort, 1, "")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Page error = nil, want the sort error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Page error: %v", err)
+			}
+			if !reflect.DeepEqual(query.Sort, tt.want) {
+				t.Errorf("sort = %v, want %v", query.Sort, tt.want)
+			}
+		})
+	}
+}
+
+// BSON date of the second of the day
+func bsonDate(sec int) primitive.DateTime {
+	return primitive.NewDateTimeFromTime(time.Date(2022, 10, 26, 10, 0, sec, 0, time.UTC))
+}
+
+// Date of the old versions kept as the string
+func stringDate(sec int) string {
+	return time.Date(2022, 10, 26, 10, 0, sec, 0, time.UTC).Format(consts.TIME_FORMAT)
+}
+
+// Users created by the old and the new versions
+func mixedDateUsers() []bson.M {
+	return []bson.M{
+		{"_id": "u1", "created_at": bsonDate(3)},
+		{"_id": "u2", "created_at": stringDate(1)},
+		{"_id": "u3", "created_at": bsonDate(1)},
+		{"_id": "u4"},
+		{"_id": "u5", "created_at": stringDate(4)},
+		{"_id": "u6", "created_at": bsonDate(2)},
+		{"_id": "u7", "created_at": stringDate(2)},
+		{"_id": "u8", "created_at": nil},
+	}
+}
+
+func TestFilterDateRange(t *testing.T) {
+	f := &BsonHelper{}
+	at := func(sec int, nsec int) time.Time {
+		return time.Date(2022, 10, 26, 10, 0, sec, nsec, time.UTC)
+	}
+	tests := []struct {
+		name string
+		r    filter_models.Range
+		want []interface{}
+	}{
+		{name: "from", r: filter_models.Range{Field: "created_at", From: at(2, 0)},
+			want: []interface{}{"u1", "u5", "u6", "u7"}},
+		{name: "to", r: filter_models.Range{Field: "created_at", To: at(2, 0)},
+			want: []interface{}{"u2", "u3"}},
+		{name: "from to", r: filter_models.Range{Field: "created_at",
+			From: at(2, 0), To: at(4, 0)}, want: []interface{}{"u1", "u6", "u7"}},
+		// the strings have no fraction of the second
+		{name: "from the fraction", r: filter_models.Range{Field: "created_at",
+			From: at(1, 500000000)}, want: []interface{}{"u1", "u5", "u6", "u7"}},
+		{name: "to the fraction", r: filter_models.Range{Field: "created_at",
+			To: at(2, 1000000)}, want: []interface{}{"u2", "u3", "u6", "u7"}},
+		// the range without the bounds matches all users
+		{name: "no bounds", r: filter_models.Range{Field: "created_at"},
+			want: []interface{}{"u1", "u2", "u3", "u4", "u5", "u6", "u7", "u8"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := f.Filter(filter_models.Input{Ranges: []filter_models.Range{tt.r}})
+			if err != nil {
+				t.Fatalf("Filter error: %v", err)
+			}
+			var got []interface{}
+			for _, doc := range mixedDateUsers() {
+				if mongoMatch(t, filter, doc) {
+					got = append(got, doc["_id"])
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("users = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPagesSortMixedDates(t *testing.T) {
+	f := &BsonHelper{}
+	docs := mixedDateUsers()
+	tests := []struct {
+		name string
+		desc bool
+		want []interface{}
+	}{
+		// the server sorts the strings before the dates
+		{name: "asc", want: []interface{}{"u4", "u8", "u2", "u7", "u5", "u3", "u6", "u1"}},
+		{name: "desc", desc: true,
+			want: []interface{}{"u1", "u6", "u3", "u5", "u7", "u2", "u4", "u8"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sort := []filter_models.SortField{{Field: "created_at", Desc: tt.desc}}
+			for size := int32(1); size <= int32(len(docs)); size++ {
+				got := flatten(readPages(t, f, docs, nil, sort, size))
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("size %d: users = %v, want %v", size, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestFilterDateCondition(t *testing.T) {
+	f := &BsonHelper{}
+	cond := func(op filter_models.Op, values ...interface{}) filter_models.Condition {
+		return filter_models.Condition{Field: "created_at", Op: op, Values: values}
+	}
+	tests := []struct {
+		name    string
+		cond    filter_models.Condition
+		want    []interface{}
+		wantErr bool
+	}{
+		{name: "eq", cond: cond(filter_models.EQ, stringDate(2)),
+			want: []interface{}{"u6", "u7"}},
+		// the same time in the other zone
+		{name: "eq zone", cond: cond(filter_models.EQ, "2022-10-26T12:00:02+02:00"),
+			want: []interface{}{"u6", "u7"}},
+		// only the BSON dates have the milliseconds
+		{name: "eq fraction", cond: cond(filter_models.EQ, "2022-10-26T10:00:01.5Z")},
+		{name: "in", cond: cond(filter_models.IN, stringDate(1), stringDate(4)),
+			want: []interface{}{"u2", "u3", "u5"}},
+		{name: "nin", cond: cond(filter_models.NIN, stringDate(1), stringDate(4)),
+			want: []interface{}{"u1", "u4", "u6", "u7", "u8"}},
+		{name: "exists", cond: filter_models.Condition{Field: "created_at",
+			Op: filter_models.EXISTS, Exists: false}, want: []interface{}{"u4"}},
+		{name: "not the date", cond: cond(filter_models.EQ, "yesterday"), wantErr: true},
+		{name: "prefix", cond: cond(filter_models.PREFIX, "2022-10"), wantErr: true},
+		{name: "suffix", cond: cond(filter_models.SUFFIX, "Z"), wantErr: true},
+		{name: "contains", cond: cond(filter_models.CONTAINS, "10:00"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := f.Filter(filter_models.Input{
+				Conditions: []filter_models.Condition{tt.cond}})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Filter error = nil, want the error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Filter error: %v", err)
+			}
+			var got []interface{}
+			for _, doc := range mixedDateUsers() {
+				if mongoMatch(t, filter, doc) {
+					got = append(got, doc["_id"])
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("users = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package filter
+
+import (
+	"api/consts"
+	filter_models "api/models/filter"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+Create the func matching the user snapshot with the input in the memory.
+The input is checked by the same rules as the Filter and the conditions
+have the same meaning as the store filter. The snapshot has the API field names
+and the dates formatted with TIME_FORMAT, as the change events have,
+so the dates are matched by the seconds.
+*/
+func (f *BsonHelper) Matcher(input filter_models.Input) (filter_models.MatchFunc, error) {
+	if _, err := f.Filter(input); err != nil {
+		return nil, err
+	}
+	return func(user map[string]interface{}) bool {
+		return match(input, user)
+	}, nil
+}
+
+// Check all parts of the input, they are joined with AND
+func match(input filter_models.Input, user map[string]interface{}) bool {
+	for key, values := range input.In {
+		if len(values) == 0 {
+			continue
+		}
+		// the keys of the input are the store keys
+		if key == "_id" {
+			key = "id"
+		}
+		value, ok := user[key]
+		if !ok || !contains(key, values, value) {
+			return false
+		}
+	}
+	for _, r := range input.Ranges {
+		if r.From.IsZero() && r.To.IsZero() {
+			continue
+		}
+		t, ok := userTime(user[r.Field])
+		if !ok {
+			return false
+		}
+		if !r.From.IsZero() && t.Before(r.From) {
+			return false
+		}
+		if !r.To.IsZero() && !t.Before(r.To) {
+			return false
+		}
+	}
+	for _, c := range input.Conditions {
+		if !matchCondition(c, user) {
+			return false
+		}
+	}
+	if input.Expression != nil && !matchExpression(input.Expression, user) {
+		return false
+	}
+	return true
+}
+
+func matchExpression(e *filter_models.Expression, user map[string]interface{}) bool {
+	switch e.Type {
+	case filter_models.CONDITION:
+		return matchCondition(*e.Condition, user)
+	case filter_models.NOT:
+		return !matchExpression(e.Children[0], user)
+	case filter_models.AND:
+		for _, c := range e.Children {
+			if !matchExpression(c, user) {
+				return false
+			}
+		}
+		return true
+	case filter_models.OR:
+		for _, c := range e.Children {
+			if matchExpression(c, user) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check the condition like the store does: the missing field matches only
+// the NIN and the not exists conditions
+func matchCondition(c filter_models.Condition, user map[string]interface{}) bool {
+	value, ok := user[c.Field]
+	switch c.Op {
+	case filter_models.EXISTS:
+		return ok == c.Exists
+	case filter_models.NIN:
+		return !ok || !contains(c.Field, c.Values, value)
+	}
+	if !ok {
+		return false
+	}
+	switch c.Op {
+	case filter_models.EQ:
+		return equal(c.Field, value, c.Values[0])
+	case filter_models.IN:
+		return contains(c.Field, c.Values, value)
+	}
+	// the regex of the store matches only the strings
+	s, ok := value.(string)
+	if !ok {
+		return false
+	}
+	switch c.Op {
+	case filter_models.PREFIX:
+		return strings.HasPrefix(s, fmt.Sprint(c.Values[0]))
+	case filter_models.SUFFIX:
+		return strings.HasSuffix(s, fmt.Sprint(c.Values[0]))
+	case filter_models.CONTAINS:
+		return strings.Contains(strings.ToLower(s), strings.ToLower(fmt.Sprint(c.Values[0])))
+	}
+	return false
+}
+
+func contains(field string, values []interface{}, value interface{}) bool {
+	for _, v := range values {
+		if equal(field, value, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Compare the values like the store: the numbers by the value and other
+// values only with the same type, so 5 doesn't equal "5".
+// The dates and the strings of the old documents are compared as the times.
+func equal(field string, a interface{}, b interface{}) bool {
+	if dateFields[field] {
+		ta, okA := userTime(a)
+		tb, okB := userTime(b)
+		return okA && okB && ta.Equal(tb)
+	}
+	if na, ok := number(a); ok {
+		nb, ok := number(b)
+		return ok && na == nb
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Get the value of the number of any type
+func number(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// Get the time of the date field, old documents keep dates as strings
+func userTime(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, true
+	case primitive.DateTime:
+		return v.Time(), true
+	case string:
+		t, err := time.Parse(consts.TIME_FORMAT, v)
+		return t, err == nil
+	}
+	return time.Time{}, false
+}
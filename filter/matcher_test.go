@@ -0,0 +1,136 @@
+package filter
+
+import (
+	filter_models "api/models/filter"
+	store_models "api/models/store"
+	"api/util"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Users of the store, some are written by the old versions and the scripts
+func matcherUsers() []bson.M {
+	return []bson.M{
+		{"_id": "u1", "first_name": "Bob", "country": "DE", "email": "bob@corp.com",
+			"nickname": nil, "created_at": bsonDate(1), "version": int32(5)},
+		{"_id": "u2", "first_name": "alice", "country": "FR", "email": "alice@mail.com",
+			"created_at": stringDate(2), "version": int64(2)},
+		{"_id": "u3", "first_name": "Carol", "country": int32(5), "nickname": "c",
+			"email": "carol@mail.com", "created_at": bsonDate(2)},
+		{"_id": "u4", "first_name": "5", "email": "x@corp.com", "updated_at": stringDate(3)},
+	}
+}
+
+func TestMatcherLikeStore(t *testing.T) {
+	f := &BsonHelper{}
+	cond := func(field string, op filter_models.Op,
+		values ...interface{}) filter_models.Condition {
+
+		return filter_models.Condition{Field: field, Op: op, Values: values}
+	}
+	node := func(c filter_models.Condition) *filter_models.Expression {
+		return &filter_models.Expression{Type: filter_models.CONDITION, Condition: &c}
+	}
+	conditions := func(c ...filter_models.Condition) filter_models.Input {
+		return filter_models.Input{Conditions: c}
+	}
+	tests := []struct {
+		name  string
+		input filter_models.Input
+		want  []interface{}
+	}{
+		{name: "in", input: filter_models.Input{In: map[string][]interface{}{
+			"country": {"DE", "FR"}}}, want: []interface{}{"u1", "u2"}},
+		{name: "in id", input: filter_models.Input{In: map[string][]interface{}{
+			"_id": {"u2", "u4"}}}, want: []interface{}{"u2", "u4"}},
+		// the number isn't the string
+		{name: "in number", input: filter_models.Input{In: map[string][]interface{}{
+			"country": {"5"}}}},
+		{name: "eq number", input: conditions(cond("country", filter_models.EQ, "5"))},
+		{name: "nin number", input: conditions(cond("country", filter_models.NIN, "5", "DE")),
+			want: []interface{}{"u2", "u3", "u4"}},
+		{name: "contains number", input: conditions(cond("country", filter_models.CONTAINS, "5"))},
+		{name: "prefix string", input: conditions(cond("first_name", filter_models.PREFIX, "5")),
+			want: []interface{}{"u4"}},
+		{name: "suffix case", input: conditions(cond("email", filter_models.SUFFIX, "@CORP.com"))},
+		{name: "contains case", input: conditions(cond("email", filter_models.CONTAINS, "CORP")),
+			want: []interface{}{"u1", "u4"}},
+		// null is the existing field
+		{name: "exists null", input: filter_models.Input{Conditions: []filter_models.Condition{
+			{Field: "nickname", Op: filter_models.EXISTS, Exists: true}}},
+			want: []interface{}{"u1", "u3"}},
+		{name: "eq null", input: conditions(cond("nickname", filter_models.EQ, "c")),
+			want: []interface{}{"u3"}},
+		// the dates and the old strings
+		{name: "eq date", input: conditions(cond("created_at", filter_models.EQ, stringDate(2))),
+			want: []interface{}{"u2", "u3"}},
+		{name: "eq date zone", input: conditions(cond("created_at", filter_models.EQ,
+			"2022-10-26T12:00:01+02:00")), want: []interface{}{"u1"}},
+		{name: "in dates", input: conditions(cond("created_at", filter_models.IN,
+			stringDate(1), stringDate(3))), want: []interface{}{"u1"}},
+		{name: "nin date", input: conditions(cond("created_at", filter_models.NIN, stringDate(1))),
+			want: []interface{}{"u2", "u3", "u4"}},
+		{name: "eq old string date", input: conditions(cond("updated_at", filter_models.EQ,
+			stringDate(3))), want: []interface{}{"u4"}},
+		{name: "range", input: filter_models.Input{Ranges: []filter_models.Range{
+			{Field: "created_at", From: bsonDate(2).Time()}}},
+			want: []interface{}{"u2", "u3"}},
+		{name: "expression", input: filter_models.Input{Expression: &filter_models.Expression{
+			Type: filter_models.OR, Children: []*filter_models.Expression{
+				node(cond("country", filter_models.EQ, "DE")),
+				{Type: filter_models.AND, Children: []*filter_models.Expression{
+					node(cond("email", filter_models.SUFFIX, "@corp.com")),
+					{Type: filter_models.NOT, Children: []*filter_models.Expression{
+						node(filter_models.Condition{Field: "nickname",
+							Op: filter_models.EXISTS, Exists: true})}},
+				}},
+			}}}, want: []interface{}{"u1", "u4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := f.Filter(tt.input)
+			if err != nil {
+				t.Fatalf("Filter error: %v", err)
+			}
+			matcher, err := f.Matcher(tt.input)
+			if err != nil {
+				t.Fatalf("Matcher error: %v", err)
+			}
+			var inStore, matched []interface{}
+			for _, doc := range matcherUsers() {
+				if mongoMatch(t, filter, doc) {
+					inStore = append(inStore, doc["_id"])
+				}
+				// the change events have the public snapshots
+				if matcher(util.PublicUser(store_models.IStoreGetResponse(doc))) {
+					matched = append(matched, doc["_id"])
+				}
+			}
+			if !reflect.DeepEqual(inStore, tt.want) {
+				t.Errorf("the store query matches %v, want %v", inStore, tt.want)
+			}
+			if !reflect.DeepEqual(matched, tt.want) {
+				t.Errorf("the matcher matches %v, want %v", matched, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatcherInvalidInput(t *testing.T) {
+	f := &BsonHelper{}
+	// the matcher has the rules of the store filter
+	inputs := []filter_models.Input{
+		{Conditions: []filter_models.Condition{{Field: "password",
+			Op: filter_models.EQ, Values: []interface{}{"x"}}}},
+		{Conditions: []filter_models.Condition{{Field: "created_at",
+			Op: filter_models.PREFIX, Values: []interface{}{"2022"}}}},
+		{Expression: &filter_models.Expression{Type: filter_models.NOT}},
+	}
+	for _, input := range inputs {
+		if _, err := f.Matcher(input); err == nil {
+			t.Errorf("Matcher(%+v) error = nil, want the invalid input", input)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package filter
+
+import (
+	filter_models "api/models/filter"
+	store_models "api/models/store"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+The store queries are checked in the memory with the semantics
+of the MongoDB server, as the tests have no server:
+the comparison operators match only the values of the same type,
+null matches the missing field and the sort order brackets the types.
+Only the operators created by the BsonHelper are supported.
+*/
+
+// Order of the type brackets in the sort, null is the missing field too
+func typeOrder(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 1
+	case int, int32, int64, float64:
+		return 2
+	case string:
+		return 3
+	case bool:
+		return 8
+	case primitive.DateTime, time.Time:
+		return 9
+	}
+	return 10
+}
+
+// Compare the values like the sort of the server
+func compareValues(a, b interface{}) int {
+	if ta, tb := typeOrder(a), typeOrder(b); ta != tb {
+		return ta - tb
+	}
+	switch av := a.(type) {
+	case nil:
+		return 0
+	case string:
+		return strings.Compare(av, b.(string))
+	case bool:
+		if av == b.(bool) {
+			return 0
+		}
+		if !av {
+			return -1
+		}
+		return 1
+	case primitive.DateTime, time.Time:
+		return compareFloats(float64(dateMillis(a)), float64(dateMillis(b)))
+	}
+	if typeOrder(a) == 2 {
+		return compareFloats(toFloat(a), toFloat(b))
+	}
+	panic(fmt.Sprintf("can't compare %T", a))
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	}
+	return v.(float64)
+}
+
+func dateMillis(v interface{}) int64 {
+	if t, ok := v.(time.Time); ok {
+		return t.UnixMilli()
+	}
+	return int64(v.(primitive.DateTime))
+}
+
+// Elements of the filter document, the order doesn't matter for the match
+func filterElems(t *testing.T, filter interface{}) []bson.E {
+	switch f := filter.(type) {
+	case nil:
+		return nil
+	case bson.D:
+		return f
+	case bson.M:
+		elems := make([]bson.E, 0, len(f))
+		for k, v := range f {
+			elems = append(elems, bson.E{Key: k, Value: v})
+		}
+		return elems
+	}
+	t.Fatalf("unexpected filter %T", filter)
+	return nil
+}
+
+// Items of the array of the filter
+func filterArray(t *testing.T, value interface{}) []interface{} {
+	switch a := value.(type) {
+	case bson.A:
+		return a
+	case []interface{}:
+		return a
+	case []bson.D:
+		items := make([]interface{}, 0, len(a))
+		for _, d := range a {
+			items = append(items, d)
+		}
+		return items
+	}
+	t.Fatalf("unexpected array %T", value)
+	return nil
+}
+
+// Check if the document matches the filter like the server
+func mongoMatch(t *testing.T, filter interface{}, doc bson.M) bool {
+	for _, e := range filterElems(t, filter) {
+		switch e.Key {
+		case "$and", "$or", "$nor":
+			matched := 0
+			items := filterArray(t, e.Value)
+			for _, item := range items {
+				if mongoMatch(t, item, doc) {
+					matched++
+				}
+			}
+			if (e.Key == "$and" && matched != len(items)) ||
+				(e.Key == "$or" && matched == 0) || (e.Key == "$nor" && matched != 0) {
+				return false
+			}
+			continue
+		}
+		if !matchField(t, e.Value, doc, e.Key) {
+			return false
+		}
+	}
+	return true
+}
+
+// Check the condition of the field
+func matchField(t *testing.T, cond interface{}, doc bson.M, key string) bool {
+	value, ok := doc[key]
+	switch c := cond.(type) {
+	case primitive.Regex:
+		return matchRegex(t, c, value)
+	case bson.D:
+		if len(c) != 0 && strings.HasPrefix(c[0].Key, "$") {
+			for _, op := range c {
+				if !matchOperator(t, op, value, ok) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return mongoEqual(value, ok, cond)
+}
+
+func matchOperator(t *testing.T, op bson.E, value interface{}, ok bool) bool {
+	switch op.Key {
+	case "$eq":
+		return mongoEqual(value, ok, op.Value)
+	case "$ne":
+		return !mongoEqual(value, ok, op.Value)
+	case "$in", "$nin":
+		in := false
+		for _, item := range filterArray(t, op.Value) {
+			if r, isRegex := item.(primitive.Regex); isRegex {
+				in = in || matchRegex(t, r, value)
+			} else {
+				in = in || mongoEqual(value, ok, item)
+			}
+		}
+		return in == (op.Key == "$in")
+	case "$gt", "$gte", "$lt", "$lte":
+		// the range matches only the values of the same type
+		if !ok || value == nil || typeOrder(value) != typeOrder(op.Value) {
+			return false
+		}
+		c := compareValues(value, op.Value)
+		return map[string]bool{"$gt": c > 0, "$gte": c >= 0,
+			"$lt": c < 0, "$lte": c <= 0}[op.Key]
+	case "$exists":
+		return ok == op.Value.(bool)
+	case "$type":
+		switch op.Value {
+		case "date":
+			return typeOrder(value) == 9
+		case "string":
+			return typeOrder(value) == 3
+		}
+	}
+	t.Fatalf("unexpected operator %s", op.Key)
+	return false
+}
+
+// Null matches the missing field, other values match only the same type
+func mongoEqual(value interface{}, ok bool, target interface{}) bool {
+	if target == nil {
+		return !ok || value == nil
+	}
+	return ok && typeOrder(value) == typeOrder(target) &&
+		compareValues(value, target) == 0
+}
+
+// The regex matches only the strings
+func matchRegex(t *testing.T, r primitive.Regex, value interface{}) bool {
+	s, ok := value.(string)
+	if !ok {
+		return false
+	}
+	pattern := r.Pattern
+	if strings.Contains(r.Options, "i") {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		t.Fatalf("invalid regex %q: %v", r.Pattern, err)
+	}
+	return re.MatchString(s)
+}
+
+// Run the query on the documents like the store
+func runQuery(t *testing.T, query *store_models.Query, docs []bson.M) []bson.M {
+	var found []bson.M
+	for _, doc := range docs {
+		if mongoMatch(t, query.Filter, doc) {
+			found = append(found, doc)
+		}
+	}
+	if sortDoc, ok := query.Sort.(bson.D); ok {
+		sort.SliceStable(found, func(i, j int) bool {
+			for _, e := range sortDoc {
+				c := compareValues(found[i][e.Key], found[j][e.Key])
+				if e.Value == -1 {
+					c = -c
+				}
+				if c != 0 {
+					return c < 0
+				}
+			}
+			return false
+		})
+	}
+	if query.Limit > 0 && int64(len(found)) > query.Limit {
+		found = found[:query.Limit]
+	}
+	return found
+}
+
+// Read all pages of the documents like the API does, return the ids of the pages
+func readPages(t *testing.T, f *BsonHelper, docs []bson.M, filter interface{},
+	sortFields []filter_models.SortField, size int32) [][]interface{} {
+
+	var pages [][]interface{}
+	token := ""
+	for {
+		query, err := f.Page(filter, sortFields, size, token)
+		if err != nil {
+			t.Fatalf("Page error: %v", err)
+		}
+		found := runQuery(t, query, docs)
+		more := len(found) > int(size)
+		if more {
+			found = found[:size]
+		}
+		var ids []interface{}
+		for _, doc := range found {
+			ids = append(ids, doc["_id"])
+		}
+		pages = append(pages, ids)
+		if !more {
+			return pages
+		}
+		if len(pages) > len(docs) {
+			t.Fatalf("the pages don't end: %v", pages)
+		}
+		token, err = f.PageToken(query, store_models.IStoreGetResponse(found[len(found)-1]))
+		if err != nil {
+			t.Fatalf("PageToken error: %v", err)
+		}
+	}
+}
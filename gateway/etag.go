@@ -0,0 +1,66 @@
+package gateway
+
+import (
+	"api/consts"
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Response with the version of the user
+type versioned interface {
+	GetVersion() int64
+}
+
+// Set the version of the returned user as the ETag header,
+// the client sends it back in the If-Match header of the next change
+func ETag(ctx context.Context, w http.ResponseWriter, m proto.Message) error {
+	if v, ok := m.(versioned); ok && v.GetVersion() > 0 {
+		w.Header().Set("ETag", fmt.Sprintf("%q", fmt.Sprint(v.GetVersion())))
+	}
+	return nil
+}
+
+/*
+Write the gRPC error as the default error handler does.
+The version mismatch is returned as 412 Precondition Failed
+instead of 409 Conflict of the Aborted code.
+*/
+func ErrorHandler(ctx context.Context, mux *runtime.ServeMux,
+	marshaler runtime.Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+
+	if isVersionMismatch(err) {
+		w = &statusWriter{ResponseWriter: w, status: http.StatusPreconditionFailed}
+	}
+	runtime.DefaultHTTPErrorHandler(ctx, mux, marshaler, w, r, err)
+}
+
+func isVersionMismatch(err error) bool {
+	s, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+	for _, detail := range s.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok &&
+			info.Domain == consts.GRPC_ERROR_DOMAIN &&
+			info.Reason == consts.GRPC_REASON_VERSION_MISMATCH {
+			return true
+		}
+	}
+	return false
+}
+
+// Writer replacing the status code of the response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(int) {
+	w.ResponseWriter.WriteHeader(w.status)
+}
@@ -0,0 +1,48 @@
+package gateway
+
+import (
+	"net/http"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+)
+
+// MIME type of the server-sent events
+const SSE_CONTENT_TYPE = "text/event-stream"
+
+// SSEMarshaler writes the messages of the server streams as the server-sent events,
+// one JSON message in the data field of the event. Requests are decoded as JSON.
+type SSEMarshaler struct {
+	runtime.JSONPb
+}
+
+func (m *SSEMarshaler) ContentType(v interface{}) string {
+	return SSE_CONTENT_TYPE
+}
+
+// The JSON is written without the line breaks, so it fits one data field
+func (m *SSEMarshaler) Marshal(v interface{}) ([]byte, error) {
+	data, err := m.JSONPb.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("data: "), data...), nil
+}
+
+// Events are separated by the empty line
+func (m *SSEMarshaler) Delimiter() []byte {
+	return []byte("\n\n")
+}
+
+// Disable the caching and the proxy buffering of the event streams
+func SSEHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, accept := range r.Header.Values("Accept") {
+			if accept == SSE_CONTENT_TYPE {
+				w.Header().Set("Cache-Control", "no-cache")
+				w.Header().Set("X-Accel-Buffering", "no")
+				break
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
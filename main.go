@@ -2,22 +2,28 @@ package main
 
 import (
 	"api/filter"
+	"api/gateway"
 	"api/health"
 	"api/services"
 	"api/util"
+	"api/validation"
 	"context"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"strings"
 
 	pb "api/proto/gen/go"
 
 	"api/metrics"
+	hasher_models "api/models/hasher"
 	logger_models "api/models/logger"
 	metric_models "api/models/metric"
 	store_models "api/models/store"
+	validator_models "api/models/validator"
 	watcher_models "api/models/watcher"
+	webhook_models "api/models/webhook"
 
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"github.com/prometheus/client_golang/prometheus"
@@ -30,11 +36,19 @@ import (
 )
 
 var (
-	store         store_models.IStore
-	watcher       watcher_models.IWatcher
-	logger        logger_models.ILogger
-	errorsCounter metric_models.IMetricCount
-	healthCounter metric_models.IMetricCount
+	store            store_models.IStore
+	watcher          watcher_models.IWatcher
+	logger           logger_models.ILogger
+	errorsCounter    metric_models.IMetricCount
+	healthCounter    metric_models.IMetricCount
+	queueGauge       metric_models.IMetricGauge
+	dropsCounter     metric_models.IMetricCount
+	subscribersGauge metric_models.IMetricGauge
+	purgedCounter    metric_models.IMetricCount
+	hasher           hasher_models.IHasher
+	webhooks         webhook_models.IWebhookRegistry
+	webhookValidator validator_models.IWebhookValidator
+	hub              watcher_models.IEventHub
 )
 
 func main() {
@@ -56,6 +70,23 @@ func main() {
 		Name: "custom_api_errors",
 		Help: "The total number of api errors",
 	})
+	queueGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "custom_api_watcher_queue_depth",
+		Help: "The number of change events waiting for the watcher",
+	})
+	dropsCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "custom_api_watcher_dropped_events",
+		Help: "The total number of change events dropped by the watcher queue",
+	})
+
+	subscribersGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "custom_api_watch_subscribers",
+		Help: "The number of the WatchUsers streams",
+	})
+	purgedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "custom_api_purged_users",
+		Help: "The total number of the soft deleted users purged after the retention",
+	})
 
 	// create the metric server and start monitoring metrics
 	metricsServer, err := metrics.NewMetricServer(
@@ -66,28 +97,109 @@ func main() {
 	go metricsServer.Start()
 	defer metricsServer.Stop(cfg.MetricsSettings.ServerRuntime)
 
-	// run and listen the watcher
-	watcher, err = services.NewPubSubWatcher("mock", "example", "")
-	if err != nil {
-		log.Fatalf("failed to init watcher: %v", err)
-	}
-	go watcher.Listen()
-	defer watcher.Close()
-
 	// init the store client
-	store, err = services.NewMongoStore(context.Background(),
+	mongoStore, err := services.NewMongoStore(context.Background(),
 		&store_models.StoreConfig{
-			Login:    cfg.DBSettings.Login,
-			Password: cfg.DBSettings.Password,
-			Addr:     cfg.DBSettings.Addr,
-			Port:     cfg.DBSettings.Port,
-			DB:       cfg.DBSettings.DB,
-			Table:    cfg.DBSettings.Table,
+			Login:            cfg.DBSettings.Login,
+			Password:         cfg.DBSettings.Password,
+			Addr:             cfg.DBSettings.Addr,
+			Port:             cfg.DBSettings.Port,
+			DB:               cfg.DBSettings.DB,
+			Table:            cfg.DBSettings.Table,
+			OutboxTable:      cfg.DBSettings.OutboxTable,
+			WebhooksTable:    cfg.DBSettings.WebhooksTable,
+			DeadLettersTable: cfg.DBSettings.DeadLettersTable,
+			ReadTimeout:      cfg.DBSettings.ReadTimeout,
+			WriteTimeout:     cfg.DBSettings.WriteTimeout,
+			SoftDelete:       cfg.DBSettings.SoftDelete,
 		},
 	)
 	if err != nil {
 		log.Fatalf("failed to init store client: %v", err)
 	}
+	store = mongoStore
+
+	// run the purge of the soft deleted users
+	if cfg.DBSettings.SoftDelete {
+		purger := services.NewTombstonePurger(mongoStore, cfg.DBSettings.DeletedRetention,
+			cfg.DBSettings.PurgeInterval, purgedCounter)
+		go purger.Start()
+		defer purger.Stop()
+	}
+
+	// create the watcher queue
+	queue, err := services.NewEventQueue(cfg.WatcherSettings.BufferSize,
+		watcher_models.OverflowPolicy(cfg.WatcherSettings.OverflowPolicy),
+		cfg.WatcherSettings.SpillPath, cfg.WatcherSettings.PushTimeout,
+		queueGauge, dropsCounter)
+	if err != nil {
+		log.Fatalf("failed to init watcher queue: %v", err)
+	}
+
+	// init the publisher of the watcher backend
+	var publisher watcher_models.IPublisher
+	switch watcher_models.Backend(cfg.WatcherSettings.Backend) {
+	case watcher_models.PUBSUB:
+		publisher, err = services.NewPubSubPublisher(cfg.PubSubSettings.ProjectID,
+			cfg.PubSubSettings.Topic, cfg.PubSubSettings.CredentialsPath)
+	case watcher_models.NATS:
+		publisher, err = services.NewNatsPublisher(cfg.NatsSettings.URL,
+			cfg.NatsSettings.Stream, cfg.NatsSettings.Subject)
+	case watcher_models.KAFKA:
+		publisher, err = services.NewKafkaPublisher(cfg.KafkaSettings.Brokers,
+			cfg.KafkaSettings.Topic)
+	default:
+		err = fmt.Errorf("unknown backend: %s", cfg.WatcherSettings.Backend)
+	}
+	if err != nil {
+		log.Fatalf("failed to init watcher: %v", err)
+	}
+
+	// init the webhooks of the config and the registered ones
+	webhookValidator = &validation.WebhookValidator{
+		AllowPrivateHosts: cfg.WebhookSettings.AllowPrivateHosts,
+	}
+	for _, webhook := range cfg.WebhookSettings.Endpoints {
+		if violations := webhookValidator.Validate(webhook); len(violations) != 0 {
+			log.Fatalf("invalid webhook %s: %s %s", webhook.URL,
+				violations[0].Field, violations[0].Description)
+		}
+	}
+	webhookPublisher := services.NewWebhookPublisher(cfg.WebhookSettings.Endpoints,
+		mongoStore, cfg.WebhookSettings.Timeout, cfg.WebhookSettings.MaxAttempts,
+		cfg.WebhookSettings.Workers, cfg.WebhookSettings.QueueSize)
+	webhookPublisher.AllowPrivateHosts = cfg.WebhookSettings.AllowPrivateHosts
+	webhooks = webhookPublisher
+
+	// init the fan-out of the events to the WatchUsers streams
+	eventHub := services.NewEventHub(cfg.GRPCSettings.WatchBufferSize, subscribersGauge)
+	hub = eventHub
+
+	queueWatcher := services.NewQueueWatcher(queue,
+		services.NewMultiPublisher(publisher, webhookPublisher, eventHub))
+
+	// run and listen the watcher of the event source
+	switch watcher_models.EventSource(cfg.WatcherSettings.EventSource) {
+	case watcher_models.RPC, watcher_models.OUTBOX:
+		watcher = queueWatcher
+	case watcher_models.CHANGE_STREAM:
+		csWatcher := services.NewChangeStreamWatcher(mongoStore.Collection,
+			mongoStore.Database.Collection(cfg.DBSettings.ResumeTokensTable), queueWatcher)
+		csWatcher.SoftDelete = cfg.DBSettings.SoftDelete
+		watcher = csWatcher
+	default:
+		log.Fatalf("unknown watcher event source: %s", cfg.WatcherSettings.EventSource)
+	}
+	go watcher.Listen()
+	defer watcher.Close()
+
+	// run the relay of the outbox entries to the watcher
+	if watcher_models.EventSource(cfg.WatcherSettings.EventSource) == watcher_models.OUTBOX {
+		relay := services.NewOutboxRelay(mongoStore, watcher,
+			cfg.WatcherSettings.OutboxPollInterval, cfg.WatcherSettings.OutboxMaxAttempts)
+		go relay.Start()
+		defer relay.Stop()
+	}
 
 	// init the logger
 	logger, err = services.NewCustomLogger(
@@ -96,6 +208,12 @@ func main() {
 		log.Fatalf("failed to init logger: %v", err)
 	}
 
+	// init the password hasher
+	hasher, err = services.NewPasswordHasher(cfg.SecuritySettings.PasswordHashAlgorithm)
+	if err != nil {
+		log.Fatalf("failed to init password hasher: %v", err)
+	}
+
 	// grpc serve
 	serve(cfg)
 }
@@ -126,11 +244,20 @@ func serve(cfg *Config) {
 	pb.RegisterUsersStoreServer(grpcServer,
 		&services.Server{
 			MaxProcessingGoroutines: cfg.GRPCSettings.MaxGoriutinesPerStream,
+			StreamBatchSize:         cfg.GRPCSettings.StreamBatchSize,
+			BatchMaxSize:            cfg.GRPCSettings.BatchMaxSize,
 			Store:                   store,
 			Filter:                  &filter.BsonHelper{},
 			ErrorsMetric:            errorsCounter,
-			WatcherCh:               watcher.GetChannel(),
+			WatcherQueue:            watcher.GetQueue(),
+			EventSource:             watcher_models.EventSource(cfg.WatcherSettings.EventSource),
 			Logger:                  logger,
+			Hasher:                  hasher,
+			Validator:               &validation.UserValidator{},
+			Webhooks:                webhooks,
+			WebhookValidator:        webhookValidator,
+			Hub:                     hub,
+			LegacyStatus:            cfg.GRPCSettings.LegacyStatus,
 		},
 	)
 
@@ -160,7 +287,14 @@ func serve(cfg *Config) {
 	}
 
 	// register the gRPC server endpoint
-	gwmux := runtime.NewServeMux()
+	gwmux := runtime.NewServeMux(
+		runtime.WithIncomingHeaderMatcher(headerMatcher),
+		// streams are sent as the server-sent events for "Accept: text/event-stream"
+		runtime.WithMarshalerOption(gateway.SSE_CONTENT_TYPE, &gateway.SSEMarshaler{}),
+		// versions of the users are sent as the ETag header
+		runtime.WithForwardResponseOption(gateway.ETag),
+		runtime.WithErrorHandler(gateway.ErrorHandler),
+	)
 	err = pb.RegisterUsersStoreHandler(context.Background(), gwmux, conn)
 	if err != nil {
 		log.Fatalln("Failed to register gateway:", err)
@@ -168,7 +302,7 @@ func serve(cfg *Config) {
 
 	gwServer := &http.Server{
 		Addr:    fmt.Sprintf(":%s", cfg.GRPCSettings.GatewayPort),
-		Handler: cors(gwmux),
+		Handler: cors(gateway.SSEHeaders(gwmux)),
 	}
 
 	log.Printf("Serving gRPC gateway on %s:%s", cfg.GRPCSettings.Host,
@@ -178,13 +312,26 @@ func serve(cfg *Config) {
 
 }
 
+// Pass the request ID header to the gRPC metadata
+func headerMatcher(key string) (string, bool) {
+	if strings.EqualFold(key, "X-Request-Id") {
+		return "x-request-id", true
+	}
+	// the expected version of the changed user
+	if strings.EqualFold(key, "If-Match") {
+		return "if-match", true
+	}
+	return runtime.DefaultHeaderMatcher(key)
+}
+
 func cors(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if util.AllowedOrigin(r.Header.Get("Origin")) {
 			w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE")
 			w.Header().Set("Access-Control-Allow-Headers",
-				"Accept, Content-Type, Content-Length, Accept-Encoding, Authorization, ResponseType")
+				"Accept, Content-Type, Content-Length, Accept-Encoding, Authorization, ResponseType, X-Request-Id, If-Match")
+			w.Header().Set("Access-Control-Expose-Headers", "ETag")
 		}
 		if r.Method == "OPTIONS" {
 			return
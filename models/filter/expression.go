@@ -0,0 +1,20 @@
+package models
+
+// Type of the filter expression node
+type ExprType int
+
+const (
+	AND       ExprType = 1
+	OR        ExprType = 2
+	NOT       ExprType = 3
+	CONDITION ExprType = 4
+)
+
+// Node of the boolean filter expression
+type Expression struct {
+	Type ExprType
+	// AND and OR have any number of children, NOT has the one child
+	Children []*Expression
+	// used by CONDITION
+	Condition *Condition
+}
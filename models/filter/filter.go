@@ -1,5 +1,18 @@
 package models
 
+import store_models "api/models/store"
+
+// Checks if the user snapshot matches the filter.
+// The snapshot has the API field names, e.g. "id".
+type MatchFunc func(user map[string]interface{}) bool
+
 type IFilter interface {
-	Filter(map[string][]interface{}) interface{}
+	Filter(Input) (interface{}, error)
+	Page(filter interface{}, sort []SortField,
+		size int32, token string) (*store_models.Query, error)
+	PageToken(*store_models.Query, store_models.IStoreGetResponse) (string, error)
+	// the in-memory version of the Filter
+	Matcher(Input) (MatchFunc, error)
+	// the store projection of the fields, nil for all fields
+	Projection(fields []string) (interface{}, error)
 }
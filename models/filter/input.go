@@ -0,0 +1,46 @@
+package models
+
+// Operator of the field condition
+type Op int
+
+const (
+	EQ       Op = 1
+	IN       Op = 2
+	NIN      Op = 3
+	PREFIX   Op = 4
+	SUFFIX   Op = 5
+	CONTAINS Op = 6
+	EXISTS   Op = 7
+)
+
+// Condition on the one field
+type Condition struct {
+	Field string
+	Op    Op
+	// EQ, PREFIX, SUFFIX and CONTAINS use the one value
+	Values []interface{}
+	// used by EXISTS
+	Exists bool
+}
+
+// Input of the filter, all parts are joined with AND
+type Input struct {
+	// field values, the field matches one of them
+	In map[string][]interface{}
+	// date ranges
+	Ranges []Range
+	// field conditions
+	Conditions []Condition
+	// boolean expression of the field conditions
+	Expression *Expression
+}
+
+// Check the input has no conditions
+func (in *Input) IsEmpty() bool {
+	for _, values := range in.In {
+		if len(values) != 0 {
+			return false
+		}
+	}
+	return len(in.Ranges) == 0 && len(in.Conditions) == 0 && in.Expression == nil
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// Range of the field values, the zero bound is not set
+type Range struct {
+	Field string
+	// inclusive lower bound
+	From time.Time
+	// exclusive upper bound
+	To time.Time
+}
@@ -0,0 +1,7 @@
+package models
+
+// Sort order by the one field
+type SortField struct {
+	Field string
+	Desc  bool
+}
@@ -0,0 +1,7 @@
+package models
+
+// IHasher hashes and verifies passwords
+type IHasher interface {
+	Hash(password string) (string, error)
+	Verify(hash string, password string) (bool, error)
+}
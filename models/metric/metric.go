@@ -3,3 +3,7 @@ package models
 type IMetricCount interface {
 	Add(float64)
 }
+
+type IMetricGauge interface {
+	Set(float64)
+}
@@ -0,0 +1,9 @@
+package models
+
+// Result of one request of the batch
+type BatchResult struct {
+	// the document before the change, nil if the request failed
+	Before IStoreGetResponse
+	// failure of the request, nil if the document is changed
+	Err error
+}
@@ -1,5 +1,7 @@
 package models
 
+import "time"
+
 type StoreConfig struct {
 	Login    string
 	Password string
@@ -7,4 +9,15 @@ type StoreConfig struct {
 	Port     string
 	DB       string
 	Table    string
+	// table of the change events outbox
+	OutboxTable string
+	// tables of the registered webhooks and the failed deliveries
+	WebhooksTable    string
+	DeadLettersTable string
+	// default timeouts of the read and write operations,
+	// the earlier deadline of the request is kept
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// deleted documents are kept with deleted_at until they are purged
+	SoftDelete bool
 }
@@ -3,3 +3,29 @@ package models
 type IStoreDoRequest interface {
 	GetID() interface{}
 }
+
+// Request changing the document only if it has the expected version.
+// The version 0 matches any document.
+type IVersionedRequest interface {
+	IStoreDoRequest
+	GetVersion() int64
+}
+
+// Partial update of the document: the fields of the Set are written,
+// the Unset fields are removed
+type UpdateRequest struct {
+	ID interface{}
+	// the expected version, 0 means any version
+	Version int64
+	Set     IStoreDoRequest
+	// store keys of the removed fields
+	Unset []string
+}
+
+func (r *UpdateRequest) GetID() interface{} {
+	return r.ID
+}
+
+func (r *UpdateRequest) GetVersion() int64 {
+	return r.Version
+}
@@ -0,0 +1,60 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of the store errors, check them with errors.Is
+var (
+	// the document doesn't exist
+	ErrNotFound = errors.New("the document is not found")
+	// the unique field is used by the other document
+	ErrConflict = errors.New("the document conflicts with the other one")
+	// the document has the other version than the expected one
+	ErrVersionMismatch = errors.New("the document has the other version")
+	// the store failed or didn't respond in time, the request can be retried
+	ErrUnavailable = errors.New("the store is unavailable")
+	// the request can't be done by the store
+	ErrInvalid = errors.New("the store request is invalid")
+	// the request of the ordered batch isn't done after the failed one
+	ErrSkipped = errors.New("the request is skipped after the failed one")
+)
+
+// Error of the store operation.
+// It matches its kind and the cause with errors.Is,
+// e.g. ErrUnavailable and context.DeadlineExceeded.
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func NewError(kind error, err error) *Error {
+	return &Error{Kind: kind, Err: err}
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Error of the unique field conflict, it matches ErrConflict
+type ConflictError struct {
+	// the field with the same value in the other document
+	Field string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("the %s is already used", e.Field)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
@@ -6,6 +6,10 @@ const (
 	ADD    DoID = 1
 	MODIFY DoID = 2
 	DELETE DoID = 3
+	// partial update with the UpdateRequest
+	UPDATE DoID = 4
+	// restore of the soft deleted document
+	RESTORE DoID = 5
 )
 
 type GetID int
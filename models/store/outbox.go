@@ -0,0 +1,28 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// Creates the outbox message of the change from the document before the change.
+// The message is written in the same transaction as the change.
+type OutboxFunc func(before IStoreGetResponse) ([]byte, error)
+
+// Message of the outbox waiting for the delivery
+type OutboxEntry struct {
+	ID string
+	// number of the failed deliveries
+	Attempts int
+	Message  []byte
+}
+
+type IOutbox interface {
+	// claims the oldest due entry for the lease time, nil if there is no entry
+	ClaimOutbox(ctx context.Context, lease time.Duration) (*OutboxEntry, error)
+	MarkDelivered(ctx context.Context, id string) error
+	// the entry is due again at the retryAt time
+	MarkFailed(ctx context.Context, id string, retryAt time.Time) error
+	// the entry isn't delivered anymore, it's kept with the reason
+	MarkDead(ctx context.Context, id string, reason string) error
+}
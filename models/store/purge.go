@@ -0,0 +1,13 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// Store of the soft deleted documents
+type IPurgeStore interface {
+	// hard-deletes the documents deleted before the time,
+	// returns the number of the deleted documents
+	PurgeDeleted(ctx context.Context, before time.Time) (int64, error)
+}
@@ -0,0 +1,13 @@
+package models
+
+// Query for getting documents from the store
+type Query struct {
+	// store filter, nil means all documents
+	Filter interface{}
+	// sort order of the documents
+	Sort interface{}
+	// max number of documents, 0 means no limit
+	Limit int64
+	// return the soft deleted documents too
+	IncludeDeleted bool
+}
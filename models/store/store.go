@@ -1,6 +1,27 @@
 package models
 
+import "context"
+
+// The store returns the errors matching ErrNotFound, ErrConflict,
+// ErrVersionMismatch, ErrUnavailable or ErrInvalid. The operations are stopped
+// when the context is cancelled.
+// The soft deleted documents are found only by RESTORE
+// and by the queries including them.
 type IStore interface {
-	DoOne(DoID, IStoreDoRequest) error
-	Get(GetID, interface{}) ([]IStoreGetResponse, error)
+	// returns the document before the change, nil for ADD.
+	// The message of the OutboxFunc is written with the change, if the func is set.
+	DoOne(context.Context, DoID, IStoreDoRequest, OutboxFunc) (IStoreGetResponse, error)
+	Get(context.Context, GetID, *Query) ([]IStoreGetResponse, error)
+	// returns the document by the id, the projection limits
+	// the returned fields, nil returns all fields
+	GetOne(ctx context.Context, id string, projection interface{}) (IStoreGetResponse, error)
+	Stream(context.Context, GetID, *Query, int, func([]IStoreGetResponse) error) error
+	// returns the number of the documents matched by the query
+	Count(context.Context, *Query) (int64, error)
+	// does MODIFY or DELETE of the batch with one bulk write and returns
+	// the result of every request. The ordered batch stops at the first failed request.
+	// The message of the OutboxFunc of every changed document is written with the batch,
+	// if the funcs are set. The error is returned if the whole batch failed.
+	DoMany(ctx context.Context, act DoID, reqs []IStoreDoRequest,
+		ordered bool, outbox []OutboxFunc) ([]BatchResult, error)
 }
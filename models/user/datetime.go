@@ -0,0 +1,71 @@
+package models
+
+import (
+	"api/consts"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+/*
+DateTime is stored as the BSON datetime.
+Documents created before keep dates as strings in the TIME_FORMAT,
+they are still decoded.
+*/
+type DateTime time.Time
+
+func (d DateTime) Time() time.Time {
+	return time.Time(d)
+}
+
+func (d DateTime) IsZero() bool {
+	return time.Time(d).IsZero()
+}
+
+func (d DateTime) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	return bson.MarshalValue(time.Time(d).UTC())
+}
+
+func (d *DateTime) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	raw := bson.RawValue{Type: t, Value: data}
+	switch t {
+	case bsontype.DateTime:
+		*d = DateTime(raw.Time().UTC())
+	case bsontype.String:
+		// the old string format
+		parsed, err := time.Parse(consts.TIME_FORMAT, raw.StringValue())
+		if err != nil {
+			return err
+		}
+		*d = DateTime(parsed.UTC())
+	case bsontype.Null, bsontype.Undefined:
+		*d = DateTime{}
+	default:
+		return fmt.Errorf("cannot decode %v into a DateTime", t)
+	}
+	return nil
+}
+
+func (d DateTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Time(d).UTC().Format(consts.TIME_FORMAT))
+}
+
+func (d *DateTime) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if s == "" {
+		*d = DateTime{}
+		return nil
+	}
+	parsed, err := time.Parse(consts.TIME_FORMAT, s)
+	if err != nil {
+		return err
+	}
+	*d = DateTime(parsed.UTC())
+	return nil
+}
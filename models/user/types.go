@@ -8,6 +8,8 @@ type (
 	Password  string
 	Email     string
 	Country   string
-	CreatedAt string
-	UpdatedAt string
+	// version of the user, it's increased by every change
+	Version   int64
+	CreatedAt = DateTime
+	UpdatedAt = DateTime
 )
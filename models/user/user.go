@@ -10,6 +10,7 @@ type User struct {
 	Country   `json:"country,omitempty" bson:"country,omitempty"`
 	CreatedAt `json:"created_at,omitempty" bson:"created_at,omitempty"`
 	UpdatedAt `json:"updated_at,omitempty" bson:"updated_at,omitempty"`
+	Version   `json:"version,omitempty" bson:"version,omitempty"`
 }
 
 func (u *User) GetID() interface{} {
@@ -19,3 +20,8 @@ func (u *User) GetID() interface{} {
 func (u *User) SetID() interface{} {
 	return u.ID
 }
+
+// the expected version of the changed user, 0 means any version
+func (u *User) GetVersion() int64 {
+	return int64(u.Version)
+}
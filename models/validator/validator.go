@@ -0,0 +1,20 @@
+package models
+
+import (
+	user_models "api/models/user"
+	webhook_models "api/models/webhook"
+)
+
+// Violation of the field rule
+type FieldViolation struct {
+	Field       string
+	Description string
+}
+
+type IValidator interface {
+	Validate(*user_models.User) []FieldViolation
+}
+
+type IWebhookValidator interface {
+	Validate(*webhook_models.Webhook) []FieldViolation
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Version of the ChangeEvent schema,
+// it's increased on the incompatible changes
+const EVENT_SCHEMA_VERSION = 1
+
+// Type of the user change
+type EventType string
+
+const (
+	USER_ADDED    EventType = "user.added"
+	USER_MODIFIED EventType = "user.modified"
+	USER_DELETED  EventType = "user.deleted"
+	// the soft deleted user is restored
+	USER_RESTORED EventType = "user.restored"
+)
+
+// Snapshot of the user, secrets are stripped
+type UserSnapshot map[string]interface{}
+
+// ChangeEvent describes one change of the user
+type ChangeEvent struct {
+	// the same for the repeated publishing of the event
+	ID            string    `json:"id"`
+	SchemaVersion int       `json:"schema_version"`
+	Type          EventType `json:"type"`
+	UserID        string    `json:"user_id"`
+	// fields changed by the request
+	ChangedFields []string `json:"changed_fields,omitempty"`
+	// the user before the change, empty for the added user
+	Before UserSnapshot `json:"before,omitempty"`
+	// the user after the change, empty for the deleted user
+	After     UserSnapshot `json:"after,omitempty"`
+	Timestamp time.Time    `json:"timestamp"`
+	RequestID string       `json:"request_id,omitempty"`
+}
+
+// Serialize the event to JSON
+func (e *ChangeEvent) Marshal() ([]byte, error) {
+	return json.Marshal(e)
+}
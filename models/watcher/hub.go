@@ -0,0 +1,26 @@
+package models
+
+import "errors"
+
+var (
+	// the subscriber didn't read the events in time
+	ErrSlowSubscriber = errors.New("the subscriber is too slow, the events are dropped")
+	ErrHubClosed      = errors.New("the event hub is closed")
+)
+
+// Fan-out of the change events to the subscribers
+type IEventHub interface {
+	// returns ErrHubClosed after the hub is closed
+	Subscribe() (ISubscription, error)
+}
+
+// Events of one subscriber
+type ISubscription interface {
+	Events() <-chan *ChangeEvent
+	// closed when the subscription is dropped by the hub
+	Done() <-chan struct{}
+	// the reason of the drop
+	Err() error
+	// unsubscribe
+	Close()
+}
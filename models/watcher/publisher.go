@@ -0,0 +1,20 @@
+package models
+
+import "context"
+
+// Backend of the watcher
+type Backend string
+
+const (
+	PUBSUB Backend = "pubsub"
+	NATS   Backend = "nats"
+	KAFKA  Backend = "kafka"
+)
+
+// Publisher of the change events to the backend.
+// The user ID is the ordering key of the events.
+type IPublisher interface {
+	// publish the event and wait for the confirmation
+	Publish(context.Context, *ChangeEvent) error
+	Close()
+}
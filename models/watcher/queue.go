@@ -0,0 +1,33 @@
+package models
+
+import (
+	"context"
+	"errors"
+)
+
+// Policy of the full event queue
+type OverflowPolicy string
+
+const (
+	// the sender waits for the free place until the timeout
+	BLOCK OverflowPolicy = "block"
+	// the oldest event is dropped
+	DROP_OLDEST OverflowPolicy = "drop-oldest"
+	// new events are written to the disk
+	SPILL OverflowPolicy = "spill"
+)
+
+var ErrQueueClosed = errors.New("the event queue is closed")
+
+// Bounded queue of the change events between the API and the watcher
+type IEventQueue interface {
+	// Put the event to the queue, the full queue is waited for
+	// until the context is done. ErrQueueClosed is returned after Close.
+	Push(context.Context, *ChangeEvent) error
+	// Get the next event, it waits for the event.
+	// False is returned after Close when the queue is empty.
+	Pop() (*ChangeEvent, bool)
+	// Number of the queued events
+	Len() int
+	Close()
+}
@@ -0,0 +1,14 @@
+package models
+
+// Source of the change events
+type EventSource string
+
+const (
+	// the API sends events of its requests to the watcher queue
+	RPC EventSource = "rpc"
+	// the API writes events to the store outbox with the change
+	OUTBOX EventSource = "outbox"
+	// the watcher tails the changes of the store,
+	// the writes bypassing the API are included
+	CHANGE_STREAM EventSource = "change-stream"
+)
@@ -1,9 +1,11 @@
 package models
 
-type WatcherChannel chan string
+import "context"
 
 type IWatcher interface {
 	Listen()
 	Close()
-	GetChannel() WatcherChannel
+	GetQueue() IEventQueue
+	// publish the event and wait for the confirmation
+	Publish(context.Context, *ChangeEvent) error
 }
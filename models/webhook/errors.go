@@ -0,0 +1,9 @@
+package models
+
+import "errors"
+
+var (
+	ErrWebhookNotFound = errors.New("the webhook is not found")
+	// the webhooks of the config can't be changed by requests
+	ErrWebhookReadOnly = errors.New("the webhook is set by the config")
+)
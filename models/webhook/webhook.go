@@ -0,0 +1,59 @@
+package models
+
+import (
+	watcher_models "api/models/watcher"
+	"context"
+	"time"
+)
+
+// Endpoint receiving the change events
+type Webhook struct {
+	ID  string `json:"id" yaml:"id" bson:"_id"`
+	URL string `json:"url" yaml:"url" bson:"url"`
+	// key of the HMAC-SHA256 signature
+	Secret string `json:"secret" yaml:"secret" bson:"secret"`
+	// subscribed event types, all events if it's empty
+	Events    []watcher_models.EventType `json:"events" yaml:"events" bson:"events"`
+	CreatedAt time.Time                  `json:"created_at" yaml:"created_at" bson:"created_at"`
+}
+
+// Check if the webhook is subscribed to the event type
+func (w *Webhook) Subscribed(eventType watcher_models.EventType) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, t := range w.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivery failed after all attempts
+type DeadLetter struct {
+	ID        string `bson:"_id"`
+	WebhookID string `bson:"webhook_id"`
+	URL       string `bson:"url"`
+	// the JSON event
+	Event     string    `bson:"event"`
+	Attempts  int       `bson:"attempts"`
+	LastError string    `bson:"last_error"`
+	CreatedAt time.Time `bson:"created_at"`
+}
+
+// Store of the registered webhooks and the dead letters
+type IWebhookStore interface {
+	AddWebhook(context.Context, *Webhook) error
+	ListWebhooks(context.Context) ([]*Webhook, error)
+	// returns ErrWebhookNotFound if there is no webhook
+	DeleteWebhook(ctx context.Context, id string) error
+	AddDeadLetter(context.Context, *DeadLetter) error
+}
+
+// Webhooks available for the admin requests
+type IWebhookRegistry interface {
+	Register(context.Context, *Webhook) error
+	List(context.Context) ([]*Webhook, error)
+	Delete(ctx context.Context, id string) error
+}
@@ -0,0 +1,323 @@
+package services
+
+import (
+	"api/consts"
+	store_models "api/models/store"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	pb "api/proto/gen/go"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+Failure of the request.
+It's returned as the gRPC status with the ErrorInfo and BadRequest details,
+the gateway converts the code to the HTTP status.
+In the legacy mode it's set to the deprecated status fields of the response.
+*/
+type apiError struct {
+	code    codes.Code
+	reason  string
+	message string
+	// ErrorInfo metadata, e.g. the id of the missing user
+	metadata map[string]string
+	// invalid fields of the request
+	violations []*pb.FieldViolation
+}
+
+// The request is wrong
+func badRequest(err interface{}) *apiError {
+	return &apiError{
+		code:    codes.InvalidArgument,
+		reason:  consts.GRPC_REASON_INVALID_REQUEST,
+		message: fmt.Sprintf(consts.STORE_BAD_REQUEST, err),
+	}
+}
+
+// Fields of the request are not valid
+func invalidFields(violations []*pb.FieldViolation) *apiError {
+	fields := make([]string, 0, len(violations))
+	for _, v := range violations {
+		fields = append(fields, v.Field)
+	}
+	return &apiError{
+		code:   codes.InvalidArgument,
+		reason: consts.GRPC_REASON_INVALID_FIELDS,
+		message: fmt.Sprintf(consts.STORE_BAD_REQUEST,
+			"invalid fields: "+strings.Join(fields, ", ")),
+		violations: violations,
+	}
+}
+
+// The key is not found in the store
+func notFound(id string) *apiError {
+	return &apiError{
+		code:     codes.NotFound,
+		reason:   consts.GRPC_REASON_NOT_FOUND,
+		message:  fmt.Sprintf(consts.STORE_KEY_NOT_FOUND, id),
+		metadata: map[string]string{"id": id},
+	}
+}
+
+// The user has been changed since the client read it
+func versionMismatch(id string, err error) *apiError {
+	return &apiError{
+		code:     codes.Aborted,
+		reason:   consts.GRPC_REASON_VERSION_MISMATCH,
+		message:  fmt.Sprintf(consts.STORE_VERSION, err),
+		metadata: map[string]string{"id": id},
+	}
+}
+
+// The request of the ordered batch isn't done after the failed one
+func skipped(id string) *apiError {
+	return &apiError{
+		code:     codes.Aborted,
+		reason:   consts.GRPC_REASON_SKIPPED,
+		message:  fmt.Sprintf("the user %s isn't changed after the failed user of the ordered batch", id),
+		metadata: map[string]string{"id": id},
+	}
+}
+
+// The unique field is used by the other user
+func conflict(err *store_models.ConflictError) *apiError {
+	return &apiError{
+		code:     codes.AlreadyExists,
+		reason:   consts.GRPC_REASON_CONFLICT,
+		message:  fmt.Sprintf(consts.STORE_CONFLICT, err),
+		metadata: map[string]string{"field": err.Field},
+		violations: []*pb.FieldViolation{{
+			Field:       err.Field,
+			Description: "is already used by the other user",
+		}},
+	}
+}
+
+// The resource can't be changed by the request
+func readOnly(err error) *apiError {
+	return &apiError{
+		code:    codes.PermissionDenied,
+		reason:  consts.GRPC_REASON_READ_ONLY,
+		message: fmt.Sprintf(consts.STORE_BAD_REQUEST, err),
+	}
+}
+
+// The store request failed, it can be retried
+func storeFailure(err error) *apiError {
+	return &apiError{
+		code:    codes.Unavailable,
+		reason:  consts.GRPC_REASON_STORE_UNAVAILABLE,
+		message: fmt.Sprintf(consts.STORE_ERROR_FAILURE, err),
+	}
+}
+
+// The WatchUsers subscription is dropped, the client should reconnect
+func watchClosed(err error) *apiError {
+	return &apiError{
+		code:    codes.Unavailable,
+		reason:  consts.GRPC_REASON_WATCH_CLOSED,
+		message: fmt.Sprintf(consts.STORE_ERROR_FAILURE, err),
+	}
+}
+
+// The server failed to process the request
+func internal(err error) *apiError {
+	return &apiError{
+		code:    codes.Internal,
+		reason:  consts.GRPC_REASON_INTERNAL,
+		message: err.Error(),
+	}
+}
+
+/*
+Convert the store error to the failure of the request.
+Failures of the store are logged and sent to the errors metric,
+the missing and the conflicting documents are the client errors.
+*/
+func (s *Server) storeError(method string, id string, err error) *apiError {
+	var conflictErr *store_models.ConflictError
+	switch {
+	case errors.As(err, &conflictErr):
+		return conflict(conflictErr)
+	case errors.Is(err, store_models.ErrConflict):
+		return &apiError{
+			code:    codes.AlreadyExists,
+			reason:  consts.GRPC_REASON_CONFLICT,
+			message: fmt.Sprintf(consts.STORE_CONFLICT, err),
+		}
+	case errors.Is(err, store_models.ErrNotFound):
+		return notFound(id)
+	case errors.Is(err, store_models.ErrVersionMismatch):
+		return versionMismatch(id, err)
+	case errors.Is(err, store_models.ErrSkipped):
+		return skipped(id)
+	case errors.Is(err, context.Canceled):
+		// the client has gone
+		return &apiError{
+			code:    codes.Canceled,
+			reason:  consts.GRPC_REASON_STORE_UNAVAILABLE,
+			message: fmt.Sprintf(consts.STORE_ERROR_FAILURE, err),
+		}
+	}
+	s.Logger.Error(method+"Error:", err.Error())
+	// send to the errors metric
+	s.ErrorsMetric.Add(1)
+	switch {
+	case errors.Is(err, store_models.ErrInvalid):
+		return badRequest(err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return &apiError{
+			code:    codes.DeadlineExceeded,
+			reason:  consts.GRPC_REASON_STORE_UNAVAILABLE,
+			message: fmt.Sprintf(consts.STORE_ERROR_FAILURE, err),
+		}
+	}
+	return storeFailure(err)
+}
+
+// Convert to the gRPC status error with the details
+func (e *apiError) Err() error {
+	st := status.New(e.code, e.message)
+	info := &errdetails.ErrorInfo{
+		Reason:   e.reason,
+		Domain:   consts.GRPC_ERROR_DOMAIN,
+		Metadata: e.metadata,
+	}
+	var details *status.Status
+	var err error
+	if len(e.violations) == 0 {
+		details, err = st.WithDetails(info)
+	} else {
+		badRequest := &errdetails.BadRequest{}
+		for _, v := range e.violations {
+			badRequest.FieldViolations = append(badRequest.FieldViolations,
+				&errdetails.BadRequest_FieldViolation{
+					Field:       v.Field,
+					Description: v.Description,
+				})
+		}
+		details, err = st.WithDetails(info, badRequest)
+	}
+	if err != nil {
+		return st.Err()
+	}
+	return details.Err()
+}
+
+// HTTP status of the deprecated status field,
+// the version mismatch is the failed precondition of HTTP
+func (e *apiError) httpStatus() int32 {
+	if e.reason == consts.GRPC_REASON_VERSION_MISMATCH {
+		return http.StatusPreconditionFailed
+	}
+	return int32(runtime.HTTPStatusFromCode(e.code))
+}
+
+// Legacy responses with the error in the status fields
+
+func (e *apiError) userResponse(id string) *pb.UserResponse {
+	message := e.message
+	return &pb.UserResponse{
+		Id:         id,
+		Status:     e.httpStatus(),
+		Error:      &message,
+		Violations: e.violations,
+	}
+}
+
+func (e *apiError) usersList() *pb.UsersList {
+	message := e.message
+	return &pb.UsersList{
+		Status: e.httpStatus(),
+		Error:  &message,
+	}
+}
+
+func (e *apiError) verifyPasswordResponse() *pb.VerifyPasswordResponse {
+	message := e.message
+	return &pb.VerifyPasswordResponse{
+		Status: e.httpStatus(),
+		Error:  &message,
+	}
+}
+
+func (e *apiError) userEvent() *pb.UserEvent {
+	message := e.message
+	return &pb.UserEvent{
+		Status: e.httpStatus(),
+		Error:  &message,
+	}
+}
+
+func (e *apiError) webhookResponse(id string) *pb.WebhookResponse {
+	message := e.message
+	return &pb.WebhookResponse{
+		Id:         id,
+		Status:     e.httpStatus(),
+		Error:      &message,
+		Violations: e.violations,
+	}
+}
+
+func (e *apiError) webhooksList() *pb.WebhooksList {
+	message := e.message
+	return &pb.WebhooksList{
+		Status: e.httpStatus(),
+		Error:  &message,
+	}
+}
+
+// Return the failure of the unary method as the gRPC status
+// or as the response in the legacy mode
+
+func (s *Server) userFailure(id string, e *apiError) (*pb.UserResponse, error) {
+	if s.LegacyStatus {
+		return e.userResponse(id), nil
+	}
+	return nil, e.Err()
+}
+
+func (s *Server) usersListFailure(e *apiError) (*pb.UsersList, error) {
+	if s.LegacyStatus {
+		return e.usersList(), nil
+	}
+	return nil, e.Err()
+}
+
+func (s *Server) verifyPasswordFailure(e *apiError) (*pb.VerifyPasswordResponse, error) {
+	if s.LegacyStatus {
+		return e.verifyPasswordResponse(), nil
+	}
+	return nil, e.Err()
+}
+
+func (s *Server) webhookFailure(id string, e *apiError) (*pb.WebhookResponse, error) {
+	if s.LegacyStatus {
+		return e.webhookResponse(id), nil
+	}
+	return nil, e.Err()
+}
+
+func (s *Server) webhooksListFailure(e *apiError) (*pb.WebhooksList, error) {
+	if s.LegacyStatus {
+		return e.webhooksList(), nil
+	}
+	return nil, e.Err()
+}
+
+// Return the failure of the stream method as the gRPC status
+// or send it as the last message in the legacy mode
+func (s *Server) streamFailure(e *apiError, send func(*apiError) error) error {
+	if s.LegacyStatus {
+		return send(e)
+	}
+	return e.Err()
+}
@@ -3,23 +3,28 @@ package services
 import (
 	"api/consts"
 	filter_models "api/models/filter"
+	hasher_models "api/models/hasher"
 	logger_models "api/models/logger"
 	metric_models "api/models/metric"
 	store_models "api/models/store"
+	validator_models "api/models/validator"
 	watcher_models "api/models/watcher"
+	webhook_models "api/models/webhook"
 
 	models "api/models/user"
 	"api/util"
 	"fmt"
+	"io"
+	"sync"
 	"time"
 
 	"context"
+	"errors"
 	"net/http"
 
 	pb "api/proto/gen/go"
 
-	"go.mongodb.org/mongo-driver/mongo"
-	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/proto"
 )
 
 // Server for the gRPC API
@@ -28,128 +33,317 @@ type Server struct {
 	pb.UnimplementedUsersStoreServer
 	// number of goroutines
 	MaxProcessingGoroutines int
+	// number of users in one stream message
+	StreamBatchSize int
+	// max number of users changed by one batch request
+	BatchMaxSize int
 	// store client
 	Store store_models.IStore
 	// filter client
 	Filter filter_models.IFilter
 	// errors metric
 	ErrorsMetric metric_models.IMetricCount
-	// watcher channel
-	WatcherCh watcher_models.WatcherChannel
+	// watcher queue
+	WatcherQueue watcher_models.IEventQueue
+	// source of the change events, the events are sent
+	// to the watcher queue only for the RPC source
+	EventSource watcher_models.EventSource
 	// logger
 	Logger logger_models.ILogger
+	// password hasher
+	Hasher hasher_models.IHasher
+	// user fields validator
+	Validator validator_models.IValidator
+	// registry of the webhooks
+	Webhooks webhook_models.IWebhookRegistry
+	// webhook fields validator
+	WebhookValidator validator_models.IWebhookValidator
+	// fan-out of the change events to the WatchUsers streams
+	Hub watcher_models.IEventHub
+	// return failures in the deprecated status fields of the responses
+	// instead of the gRPC status
+	LegacyStatus bool
 }
 
 // Add new user to the store
 func (s *Server) AddUser(ctx context.Context,
-	request *pb.User) (resp *pb.UserResponse, err error) {
+	request *pb.User) (*pb.UserResponse, error) {
+	resp, failure := s.addUser(ctx, request)
+	if failure != nil {
+		return s.userFailure("", failure)
+	}
+	return resp, nil
+}
+
+func (s *Server) addUser(ctx context.Context,
+	request *pb.User) (*pb.UserResponse, *apiError) {
 	// copy pb request to the user struct
 	user := util.ConvertUserReq(request)
+	// check the user fields
+	if failure := s.validateUser(user); failure != nil {
+		return nil, failure
+	}
 	// set updated and created time
-	user.CreatedAt = models.CreatedAt(time.Now().UTC().Format(consts.TIME_FORMAT))
-	user.UpdatedAt = models.UpdatedAt(time.Now().UTC().Format(consts.TIME_FORMAT))
+	user.CreatedAt = models.CreatedAt(time.Now().UTC())
+	user.UpdatedAt = models.UpdatedAt(time.Now().UTC())
+	// new users start from the first version
+	user.Version = 1
+	// the password is stored only as the hash
+	if err := s.hashPassword(user); err != nil {
+		s.Logger.Error("AddUserError:", err.Error())
+		// send to the errors metric
+		s.ErrorsMetric.Add(1)
+		// return error
+		return nil, internal(err)
+	}
 	// using the loop for the duplicate key error
 	for {
 		// generate new uuid user id
 		user.ID = util.GenID()
 		// add new user to the store
-		if err = s.Store.DoOne(store_models.ADD, user); err != nil {
-			if mongo.IsDuplicateKeyError(err) {
+		outbox := s.outbox(ctx, watcher_models.USER_ADDED, string(user.ID), user, nil)
+		if _, err := s.Store.DoOne(ctx, store_models.ADD, user, outbox); err != nil {
+			var conflictErr *store_models.ConflictError
+			if errors.As(err, &conflictErr) && conflictErr.Field == "_id" {
 				// repeat insert
 				continue
 			}
-			s.Logger.Error("AddUserError:", err.Error())
-			// send to the errors metric
-			s.ErrorsMetric.Add(1)
 			// return error
-			storeErr := fmt.Sprintf(consts.STORE_ERROR_FAILURE, err)
-			return &pb.UserResponse{
-				Status: http.StatusServiceUnavailable,
-				Error:  &storeErr,
-			}, nil
+			return nil, s.storeError("AddUser", "", err)
 		}
 		break
 	}
 	id := string(user.ID)
 	s.Logger.Info("AddUser:", id)
 	// inform
-	s.WatcherCh <- fmt.Sprintf("ID: %s. Added new user.", id)
+	s.inform(ctx, watcher_models.USER_ADDED, id, nil, user, nil)
 	// no errors
 	return &pb.UserResponse{
-		Id:     id,
-		Status: http.StatusOK,
+		Id:      id,
+		Status:  http.StatusOK,
+		Version: int64(user.Version),
 	}, nil
 }
 
+// Add the stream of new users to the store.
+// Inserts run concurrently, at most MaxProcessingGoroutines at a time.
+// Every request gets one response with the same index as
+// the position of the request in the stream, failures are set
+// to the status fields of the response so the stream goes on.
+func (s *Server) AddUsers(stream pb.UsersStore_AddUsersServer) error {
+	ctx := stream.Context()
+
+	maxGoroutines := s.MaxProcessingGoroutines
+	if maxGoroutines <= 0 {
+		maxGoroutines = 1
+	}
+	// limit the number of processing goroutines
+	sem := make(chan struct{}, maxGoroutines)
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		sendErr error
+	)
+	// the stream doesn't support concurrent sending
+	send := func(resp *pb.UserResponse) {
+		mu.Lock()
+		defer mu.Unlock()
+		if sendErr != nil {
+			return
+		}
+		sendErr = stream.Send(resp)
+	}
+	// the results can't reach the client after the failed send
+	// or the cancelled stream, so no more users are read
+	stopped := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if sendErr != nil {
+			return sendErr
+		}
+		return ctx.Err()
+	}
+
+	var index uint64
+	for {
+		if err := stopped(); err != nil {
+			wg.Wait()
+			return err
+		}
+		request, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			wg.Wait()
+			return err
+		}
+		sem <- struct{}{}
+		// the send could fail while waiting for the free goroutine
+		if err := stopped(); err != nil {
+			<-sem
+			wg.Wait()
+			return err
+		}
+		wg.Add(1)
+		go func(index uint64, request *pb.User) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			resp, failure := s.addUser(ctx, request)
+			if failure != nil {
+				resp = failure.userResponse("")
+			}
+			resp.Index = index
+			send(resp)
+		}(index, request)
+		index++
+	}
+	// wait for all inserts
+	wg.Wait()
+	return sendErr
+}
+
 // Modify existed user by ID
 func (s *Server) ModifyUser(ctx context.Context, request *pb.User) (*pb.UserResponse, error) {
 	// check request
 	if err := s.isValidRequest(request); err != nil {
 		// return error
-		storeErr := fmt.Sprintf(consts.STORE_BAD_REQUEST, err)
-		return &pb.UserResponse{
-			Id:     request.Id,
-			Status: http.StatusBadRequest,
-			Error:  &storeErr,
-		}, nil
+		return s.userFailure(request.Id, badRequest(err))
 	}
 	// copy pb request to the user struct
 	user := util.ConvertUserReq(request)
+	// check the user fields
+	if failure := s.validateUser(user); failure != nil {
+		return s.userFailure(request.Id, failure)
+	}
+	// the user is changed only if it has the expected version
+	version, err := util.ExpectedVersion(ctx, request.Version)
+	if err != nil {
+		return s.userFailure(request.Id, badRequest(err))
+	}
+	user.Version = models.Version(version)
 	// set updated time
-	user.UpdatedAt = models.UpdatedAt(time.Now().UTC().Format(consts.TIME_FORMAT))
-	// modify the user in the store
-	if err := s.Store.DoOne(store_models.MODIFY, user); err != nil {
+	user.UpdatedAt = models.UpdatedAt(time.Now().UTC())
+	// the password is stored only as the hash
+	if err := s.hashPassword(user); err != nil {
 		s.Logger.Error("ModifyUserError:", err.Error())
 		// send to the errors metric
 		s.ErrorsMetric.Add(1)
 		// return error
-		storeErr := fmt.Sprintf(consts.STORE_ERROR_FAILURE, err)
-		return &pb.UserResponse{
-			Id:     request.Id,
-			Status: http.StatusServiceUnavailable,
-			Error:  &storeErr,
-		}, nil
+		return s.userFailure(request.Id, internal(err))
+	}
+	// modify the user in the store
+	outbox := s.outbox(ctx, watcher_models.USER_MODIFIED, request.Id, user, nil)
+	before, err := s.Store.DoOne(ctx, store_models.MODIFY, user, outbox)
+	if err != nil {
+		// return error
+		return s.userFailure(request.Id, s.storeError("ModifyUser", request.Id, err))
 	}
 	s.Logger.Info("ModifyUser:", request.Id)
 	// inform
-	s.WatcherCh <- fmt.Sprintf("ID: %s. Modifyed user.", request.Id)
+	s.inform(ctx, watcher_models.USER_MODIFIED, request.Id, before, user, nil)
 	// no errors
 	return &pb.UserResponse{
-		Id:     request.Id,
-		Status: http.StatusOK,
+		Id:      request.Id,
+		Status:  http.StatusOK,
+		Version: util.NextVersion(before),
 	}, nil
 }
 
-// Delete an existed user by ID
+/*
+Update the fields of the update mask.
+The fields of the mask which are empty in the user are cleared,
+the empty mask updates the set fields of the user.
+*/
+func (s *Server) UpdateUser(ctx context.Context,
+	request *pb.UpdateUserRequest) (*pb.UserResponse, error) {
+	// check request
+	id := request.GetUser().GetId()
+	if id == "" {
+		return s.userFailure("", badRequest("the id field not set"))
+	}
+	set, unset, violations := util.ApplyUpdateMask(request.User, request.UpdateMask)
+	if len(violations) != 0 {
+		return s.userFailure(id, invalidFields(util.ConvertViolations(violations)))
+	}
+	if len(unset) == 0 && proto.Equal(set, &pb.User{Id: id}) {
+		return s.userFailure(id, badRequest("no fields to update"))
+	}
+	// the user is changed only if it has the expected version
+	version, err := util.ExpectedVersion(ctx, request.User.Version)
+	if err != nil {
+		return s.userFailure(id, badRequest(err))
+	}
+	// copy pb request to the user struct
+	user := util.ConvertUserReq(set)
+	// check the user fields
+	if failure := s.validateUser(user); failure != nil {
+		return s.userFailure(id, failure)
+	}
+	// set updated time
+	user.UpdatedAt = models.UpdatedAt(time.Now().UTC())
+	// the password is stored only as the hash
+	if err := s.hashPassword(user); err != nil {
+		s.Logger.Error("UpdateUserError:", err.Error())
+		// send to the errors metric
+		s.ErrorsMetric.Add(1)
+		// return error
+		return s.userFailure(id, internal(err))
+	}
+	// update the user in the store
+	update := &store_models.UpdateRequest{
+		ID:      user.ID,
+		Version: version,
+		Set:     user,
+		Unset:   unset,
+	}
+	outbox := s.outbox(ctx, watcher_models.USER_MODIFIED, id, user, unset)
+	before, err := s.Store.DoOne(ctx, store_models.UPDATE, update, outbox)
+	if err != nil {
+		// return error
+		return s.userFailure(id, s.storeError("UpdateUser", id, err))
+	}
+	s.Logger.Info("UpdateUser:", id)
+	// inform
+	s.inform(ctx, watcher_models.USER_MODIFIED, id, before, user, unset)
+	// no errors
+	return &pb.UserResponse{
+		Id:      id,
+		Status:  http.StatusOK,
+		Version: util.NextVersion(before),
+	}, nil
+}
+
+// Delete an existed user by ID.
+// In the soft delete mode the user is kept with deleted_at
+// and can be restored until it's purged.
 func (s *Server) DeleteUser(ctx context.Context, request *pb.User) (*pb.UserResponse, error) {
 	// check request
 	if err := s.isValidRequest(request); err != nil {
 		// return error
-		storeErr := fmt.Sprintf(consts.STORE_BAD_REQUEST, err)
-		return &pb.UserResponse{
-			Id:     request.Id,
-			Status: http.StatusBadRequest,
-			Error:  &storeErr,
-		}, nil
+		return s.userFailure(request.Id, badRequest(err))
 	}
 	// copy pb request to the user struct
 	user := util.ConvertUserReq(request)
+	// the user is deleted only if it has the expected version
+	version, err := util.ExpectedVersion(ctx, request.Version)
+	if err != nil {
+		return s.userFailure(request.Id, badRequest(err))
+	}
+	user.Version = models.Version(version)
 	// delete the user in the store
-	if err := s.Store.DoOne(store_models.DELETE, user); err != nil {
-		s.Logger.Error("DeleteUserError:", err.Error())
-		// send to the errors metric
-		s.ErrorsMetric.Add(1)
+	outbox := s.outbox(ctx, watcher_models.USER_DELETED, string(user.ID), nil, nil)
+	before, err := s.Store.DoOne(ctx, store_models.DELETE, user, outbox)
+	if err != nil {
 		// return error
-		storeErr := fmt.Sprintf(consts.STORE_ERROR_FAILURE, err)
-		return &pb.UserResponse{
-			Id:     request.Id,
-			Status: http.StatusServiceUnavailable,
-			Error:  &storeErr,
-		}, nil
+		return s.userFailure(request.Id, s.storeError("DeleteUser", request.Id, err))
 	}
 	s.Logger.Info("DeleteUser:", request.Id)
 	// inform
-	s.WatcherCh <- fmt.Sprintf("ID: %s. Deleted user.", string(user.ID))
+	s.inform(ctx, watcher_models.USER_DELETED, string(user.ID), before, nil, nil)
 	// no errors
 	return &pb.UserResponse{
 		Id:     request.Id,
@@ -157,66 +351,186 @@ func (s *Server) DeleteUser(ctx context.Context, request *pb.User) (*pb.UserResp
 	}, nil
 }
 
+// Restore the soft deleted user by ID
+func (s *Server) RestoreUser(ctx context.Context, request *pb.User) (*pb.UserResponse, error) {
+	// check request
+	if err := s.isValidRequest(request); err != nil {
+		// return error
+		return s.userFailure(request.Id, badRequest(err))
+	}
+	// the user is restored only if it has the expected version
+	version, err := util.ExpectedVersion(ctx, request.Version)
+	if err != nil {
+		return s.userFailure(request.Id, badRequest(err))
+	}
+	user := &models.User{
+		ID:        models.ID(request.Id),
+		UpdatedAt: models.UpdatedAt(time.Now().UTC()),
+		Version:   models.Version(version),
+	}
+	// remove deleted_at of the user in the store
+	removed := []string{"deleted_at"}
+	outbox := s.outbox(ctx, watcher_models.USER_RESTORED, request.Id, user, removed)
+	before, err := s.Store.DoOne(ctx, store_models.RESTORE, user, outbox)
+	if err != nil {
+		// return error
+		return s.userFailure(request.Id, s.storeError("RestoreUser", request.Id, err))
+	}
+	s.Logger.Info("RestoreUser:", request.Id)
+	// inform
+	s.inform(ctx, watcher_models.USER_RESTORED, request.Id, before, user, removed)
+	// no errors
+	return &pb.UserResponse{
+		Id:      request.Id,
+		Status:  http.StatusOK,
+		Version: util.NextVersion(before),
+	}, nil
+}
+
+// Compare the password with the stored hash of the user
+func (s *Server) VerifyPassword(ctx context.Context,
+	request *pb.VerifyPasswordRequest) (*pb.VerifyPasswordResponse, error) {
+	// check request
+	if request.Id == "" {
+		// return error
+		return s.verifyPasswordFailure(badRequest("the id field not set"))
+	}
+	// get the user by id
+	result, err := s.Store.GetOne(ctx, request.Id, nil)
+	if err != nil {
+		// return error
+		return s.verifyPasswordFailure(s.storeError("VerifyPassword", request.Id, err))
+	}
+	// the user without password can't be verified
+	hash, _ := result["password"].(string)
+	if hash == "" || request.Password == "" {
+		return &pb.VerifyPasswordResponse{
+			Valid:  false,
+			Status: http.StatusOK,
+		}, nil
+	}
+	valid, err := s.Hasher.Verify(hash, request.Password)
+	if err != nil {
+		s.Logger.Error("VerifyPasswordError:", err.Error())
+		// send to the errors metric
+		s.ErrorsMetric.Add(1)
+		// return error
+		return s.verifyPasswordFailure(internal(err))
+	}
+	return &pb.VerifyPasswordResponse{
+		Valid:  valid,
+		Status: http.StatusOK,
+	}, nil
+}
+
+// Get the user by ID, the read mask limits the returned fields.
+// The failure is always returned as the gRPC status.
+func (s *Server) GetUser(ctx context.Context, request *pb.GetUserRequest) (*pb.User, error) {
+	// check request
+	if request.Id == "" {
+		return nil, badRequest("the id field not set").Err()
+	}
+	projection, err := s.Filter.Projection(request.ReadMask.GetPaths())
+	if err != nil {
+		return nil, badRequest(err).Err()
+	}
+	// get the user by id
+	result, err := s.Store.GetOne(ctx, request.Id, projection)
+	if err != nil {
+		return nil, s.storeError("GetUser", request.Id, err).Err()
+	}
+	// convert the result to the user
+	users, err := util.ParseUsersToPb([]store_models.IStoreGetResponse{result})
+	if err != nil {
+		s.Logger.Error("GetUserError:", err.Error())
+		// send to the errors metric
+		s.ErrorsMetric.Add(1)
+		return nil, internal(err).Err()
+	}
+	return users[0], nil
+}
+
 // Get the list of all users
 func (s *Server) GetAllUsers(
-	context.Context, *emptypb.Empty) (*pb.UsersList, error) {
+	ctx context.Context, page *pb.PageRequest) (*pb.UsersList, error) {
+	// create the page query
+	query, err := s.Filter.Page(nil, nil, page.PageSize, page.PageToken)
+	if err != nil {
+		// return error
+		return s.usersListFailure(badRequest(err))
+	}
+	query.IncludeDeleted = page.IncludeDeleted
 	// get all users
-	results, respErr := s.Store.Get(store_models.GET_ALL, nil)
-	// convert results to user
-	users, err := util.ParseUsersToPb(results)
+	results, respErr := s.Store.Get(ctx, store_models.GET_ALL, query)
+	// the partial page is returned only in the legacy mode
+	if respErr != nil && !s.LegacyStatus {
+		return s.usersListFailure(s.storeError("GetAllUsers", "", respErr))
+	}
+	// cut the page
+	results, nextPageToken, err := s.nextPage(query, results, page.PageSize)
+	var users []*pb.User
+	if err == nil {
+		// convert results to user
+		users, err = util.ParseUsersToPb(results)
+	}
 	// check parse error
 	if err != nil {
 		s.Logger.Error("GetAllUsersError:", err.Error())
 		// send to the errors metric
 		s.ErrorsMetric.Add(1)
 		// return error
-		storeErr := fmt.Sprintf(consts.STORE_ERROR_FAILURE, err)
-		return &pb.UsersList{
-			Status: http.StatusServiceUnavailable,
-			Error:  &storeErr,
-		}, nil
+		return s.usersListFailure(storeFailure(err))
 	}
 	if respErr != nil {
-		s.Logger.Error("GetAllUsersError:", err.Error())
+		s.Logger.Error("GetAllUsersError:", respErr.Error())
 		// send to the errors metric
 		s.ErrorsMetric.Add(1)
 		// return response with some errors
 		storeErr := fmt.Sprintf(consts.STORE_ERROR_FAILURE, respErr)
 		return &pb.UsersList{
-			User:   users,
-			Status: http.StatusAccepted,
-			Error:  &storeErr,
+			User:          users,
+			Status:        http.StatusAccepted,
+			Error:         &storeErr,
+			NextPageToken: nextPageToken,
 		}, nil
 	}
 	// return response
 	return &pb.UsersList{
-		User:   users,
-		Status: http.StatusOK,
+		User:          users,
+		Status:        http.StatusOK,
+		NextPageToken: nextPageToken,
 	}, nil
 }
 
 // Get the list of filtered users
 func (s *Server) GetUsers(
 	ctx context.Context, filter *pb.UsersFilter) (*pb.UsersList, error) {
-	// convert b request
-	usersFilter := util.ConvertUserFilter(filter)
-	// create new bson filter
-	bsonUsersFilter := s.Filter.Filter(usersFilter)
+	// create the page query
+	act, query, err := s.usersQuery(filter, filter.PageSize, filter.PageToken)
+	if err != nil {
+		// return error
+		return s.usersListFailure(badRequest(err))
+	}
 	// get filtered users from the store
-	results, respErr := s.Store.Get(store_models.GET_FILTERED, bsonUsersFilter)
-	// convert results to user
-	users, err := util.ParseUsersToPb(results)
+	results, respErr := s.Store.Get(ctx, act, query)
+	// the partial page is returned only in the legacy mode
+	if respErr != nil && !s.LegacyStatus {
+		return s.usersListFailure(s.storeError("GetUsers", "", respErr))
+	}
+	// cut the page
+	results, nextPageToken, err := s.nextPage(query, results, filter.PageSize)
+	var users []*pb.User
+	if err == nil {
+		// convert results to user
+		users, err = util.ParseUsersToPb(results)
+	}
 	// check parse error
 	if err != nil {
 		s.Logger.Error("GetUsersError:", err.Error())
 		// send to the errors metric
 		s.ErrorsMetric.Add(1)
 		// return error
-		storeErr := fmt.Sprintf(consts.STORE_ERROR_FAILURE, err)
-		return &pb.UsersList{
-			Status: http.StatusServiceUnavailable,
-			Error:  &storeErr,
-		}, nil
+		return s.usersListFailure(storeFailure(err))
 	}
 	if respErr != nil {
 		s.Logger.Error("GetUsersError:", respErr.Error())
@@ -225,18 +539,249 @@ func (s *Server) GetUsers(
 		// return response with some errors
 		storeErr := fmt.Sprintf(consts.STORE_ERROR_FAILURE, respErr)
 		return &pb.UsersList{
-			User:   users,
-			Status: http.StatusAccepted,
-			Error:  &storeErr,
+			User:          users,
+			Status:        http.StatusAccepted,
+			Error:         &storeErr,
+			NextPageToken: nextPageToken,
 		}, nil
 	}
 	// return response
 	return &pb.UsersList{
-		User:   users,
-		Status: http.StatusOK,
+		User:          users,
+		Status:        http.StatusOK,
+		NextPageToken: nextPageToken,
 	}, nil
 }
 
+// Stream the list of filtered users.
+// Users are sent in batches as soon as they are read from the store,
+// an empty filter streams all users.
+func (s *Server) StreamUsers(
+	filter *pb.UsersFilter, stream pb.UsersStore_StreamUsersServer) error {
+	// create the sorted query, paging is ignored
+	act, query, err := s.usersQuery(filter, 0, "")
+	if err != nil {
+		// return error
+		return s.streamFailure(badRequest(err), func(e *apiError) error {
+			return stream.Send(e.usersList())
+		})
+	}
+	// send users from the store batch by batch
+	respErr := s.Store.Stream(stream.Context(), act, query, s.StreamBatchSize,
+		func(results []store_models.IStoreGetResponse) error {
+			// convert results to user
+			users, err := util.ParseUsersToPb(results)
+			if err != nil {
+				return err
+			}
+			return stream.Send(&pb.UsersList{
+				User:   users,
+				Status: http.StatusOK,
+			})
+		})
+	if respErr != nil {
+		// return error
+		failure := s.storeError("StreamUsers", "", respErr)
+		return s.streamFailure(failure, func(e *apiError) error {
+			return stream.Send(e.usersList())
+		})
+	}
+	return nil
+}
+
+/*
+Stream the changes of the users matching the filter.
+The modified user is sent if it matches the filter before or after the change,
+so the client knows when the user leaves the filter.
+Sort and paging of the filter are ignored.
+The slow client is disconnected with the Unavailable status.
+*/
+func (s *Server) WatchUsers(
+	filter *pb.UsersFilter, stream pb.UsersStore_WatchUsersServer) error {
+	// create the matcher of the events
+	match, err := s.Filter.Matcher(util.ConvertFilterInput(filter))
+	if err != nil {
+		// return error
+		return s.streamFailure(badRequest(err), func(e *apiError) error {
+			return stream.Send(e.userEvent())
+		})
+	}
+	sub, err := s.Hub.Subscribe()
+	if err != nil {
+		// return error
+		return s.streamFailure(watchClosed(err), func(e *apiError) error {
+			return stream.Send(e.userEvent())
+		})
+	}
+	defer sub.Close()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-sub.Done():
+			s.Logger.Info("WatchUsers:", sub.Err().Error())
+			// return error
+			return s.streamFailure(watchClosed(sub.Err()), func(e *apiError) error {
+				return stream.Send(e.userEvent())
+			})
+		case event := <-sub.Events():
+			if !matchEvent(match, event) {
+				continue
+			}
+			pbEvent, err := util.ParseEventToPb(event)
+			if err != nil {
+				s.Logger.Error("WatchUsersError:", err.Error())
+				// send to the errors metric
+				s.ErrorsMetric.Add(1)
+				continue
+			}
+			if err := stream.Send(pbEvent); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Check if the user before or after the change matches the filter.
+// The event without snapshots is matched by the user ID.
+func matchEvent(match filter_models.MatchFunc,
+	event *watcher_models.ChangeEvent) bool {
+
+	if len(event.Before) == 0 && len(event.After) == 0 {
+		return match(map[string]interface{}{"id": event.UserID})
+	}
+	for _, user := range []watcher_models.UserSnapshot{event.Before, event.After} {
+		if len(user) != 0 && match(user) {
+			return true
+		}
+	}
+	return false
+}
+
+// Create the store query from the users filter
+func (s *Server) usersQuery(filter *pb.UsersFilter, pageSize int32,
+	pageToken string) (store_models.GetID, *store_models.Query, error) {
+	// convert pb request
+	input := util.ConvertFilterInput(filter)
+	// choose the store action
+	act := store_models.GET_ALL
+	var bsonUsersFilter interface{}
+	if !input.IsEmpty() {
+		act = store_models.GET_FILTERED
+		f, err := s.Filter.Filter(input)
+		if err != nil {
+			return act, nil, err
+		}
+		bsonUsersFilter = f
+	}
+	// create the page query
+	query, err := s.Filter.Page(bsonUsersFilter,
+		util.ConvertSort(filter.Sort), pageSize, pageToken)
+	if err != nil {
+		return act, nil, err
+	}
+	query.IncludeDeleted = filter.IncludeDeleted
+	return act, query, nil
+}
+
+// Cut the extra document requested to check the next page
+// and create the token of the next page
+func (s *Server) nextPage(query *store_models.Query,
+	results []store_models.IStoreGetResponse,
+	pageSize int32) ([]store_models.IStoreGetResponse, string, error) {
+
+	if pageSize <= 0 || len(results) <= int(pageSize) {
+		return results, "", nil
+	}
+	results = results[:pageSize]
+	token, err := s.Filter.PageToken(query, results[len(results)-1])
+	if err != nil {
+		return nil, "", err
+	}
+	return results, token, nil
+}
+
+// Check the user fields.
+// Return the failure with all violations or nil.
+func (s *Server) validateUser(user *models.User) *apiError {
+	violations := s.Validator.Validate(user)
+	if len(violations) == 0 {
+		return nil
+	}
+	return invalidFields(util.ConvertViolations(violations))
+}
+
+// Send the change event of the user to the watcher.
+// The user is the written user, nil for the deleted user,
+// the removed are the fields cleared by the update.
+func (s *Server) inform(ctx context.Context, eventType watcher_models.EventType,
+	id string, before store_models.IStoreGetResponse, user *models.User,
+	removed []string) {
+
+	// the event is written to the outbox with the change
+	// or read by the watcher from the store
+	if s.EventSource == watcher_models.OUTBOX ||
+		s.EventSource == watcher_models.CHANGE_STREAM {
+		return
+	}
+	event, err := changeEvent(ctx, eventType, id, before, user, removed)
+	if err != nil {
+		s.Logger.Error("InformError:", err.Error())
+		return
+	}
+	// the queue is closed on shutdown,
+	// the full queue is waited for while the request is alive
+	if err := s.WatcherQueue.Push(ctx, event); err != nil {
+		s.Logger.Error("InformError:", err.Error())
+	}
+}
+
+// Return the func creating the outbox message of the change,
+// nil if the outbox is disabled
+func (s *Server) outbox(ctx context.Context, eventType watcher_models.EventType,
+	id string, user *models.User, removed []string) store_models.OutboxFunc {
+
+	if s.EventSource != watcher_models.OUTBOX {
+		return nil
+	}
+	return func(before store_models.IStoreGetResponse) ([]byte, error) {
+		event, err := changeEvent(ctx, eventType, id, before, user, removed)
+		if err != nil {
+			return nil, err
+		}
+		return event.Marshal()
+	}
+}
+
+// Create the change event of the user
+func changeEvent(ctx context.Context, eventType watcher_models.EventType,
+	id string, before store_models.IStoreGetResponse,
+	user *models.User, removed []string) (*watcher_models.ChangeEvent, error) {
+
+	var update store_models.IStoreGetResponse
+	if user != nil {
+		var err error
+		if update, err = util.UserDoc(user); err != nil {
+			return nil, err
+		}
+	}
+	return util.NewChangeEvent(ctx, eventType, id, before, update, removed), nil
+}
+
+// Replace the password of the user with the hash
+func (s *Server) hashPassword(user *models.User) error {
+	if user.Password == "" {
+		return nil
+	}
+	hash, err := s.Hasher.Hash(string(user.Password))
+	if err != nil {
+		return fmt.Errorf("failed to hash the password: %v", err)
+	}
+	user.Password = models.Password(hash)
+	return nil
+}
+
 // Check the valid request
 func (s *Server) isValidRequest(request *pb.User) error {
 	if request.Id == "" {
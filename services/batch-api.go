@@ -0,0 +1,243 @@
+package services
+
+import (
+	"api/consts"
+	store_models "api/models/store"
+	models "api/models/user"
+	watcher_models "api/models/watcher"
+	"api/util"
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	pb "api/proto/gen/go"
+)
+
+// Prepare the user of the batch for the store
+type batchItemFunc func(request *pb.User) (*models.User, *apiError)
+
+// Modify the users with one bulk write.
+// Every user gets the result with its index in the request.
+func (s *Server) BatchModifyUsers(ctx context.Context,
+	request *pb.BatchModifyUsersRequest) (*pb.BatchUsersResponse, error) {
+	return s.doBatch(ctx, "BatchModifyUsers", store_models.MODIFY,
+		watcher_models.USER_MODIFIED, request.Users, request.Ordered, s.modifyItem)
+}
+
+// Delete the users with one bulk write.
+// Every user gets the result with its index in the request.
+func (s *Server) BatchDeleteUsers(ctx context.Context,
+	request *pb.BatchDeleteUsersRequest) (*pb.BatchUsersResponse, error) {
+	return s.doBatch(ctx, "BatchDeleteUsers", store_models.DELETE,
+		watcher_models.USER_DELETED, request.Users, request.Ordered, s.deleteItem)
+}
+
+/*
+Delete the users matched by the filter.
+The dry run only counts the users, otherwise the confirm flag must be set
+and the filter must not match more than the max size of the batch.
+The users are deleted only if they aren't changed after they are matched.
+*/
+func (s *Server) DeleteUsersByFilter(ctx context.Context,
+	request *pb.DeleteUsersByFilterRequest) (*pb.DeleteUsersByFilterResponse, error) {
+	// check request
+	if request.Filter == nil {
+		return nil, badRequest("the filter couldn't be empty").Err()
+	}
+	act, query, err := s.usersQuery(request.Filter, 0, "")
+	if err != nil {
+		// return error
+		return nil, badRequest(err).Err()
+	}
+	if act == store_models.GET_ALL {
+		return nil, badRequest("the filter couldn't be empty").Err()
+	}
+	if !request.DryRun && !request.Confirm {
+		return nil, badRequest("confirm must be set to delete the users").Err()
+	}
+	if request.DryRun {
+		matched, err := s.Store.Count(ctx, query)
+		if err != nil {
+			return nil, s.storeError("DeleteUsersByFilter", "", err).Err()
+		}
+		return &pb.DeleteUsersByFilterResponse{
+			Matched: uint64(matched),
+			DryRun:  true,
+		}, nil
+	}
+	// one extra user is read to check the limit
+	query.Limit = int64(s.batchMaxSize()) + 1
+	results, err := s.Store.Get(ctx, act, query)
+	if err != nil {
+		return nil, s.storeError("DeleteUsersByFilter", "", err).Err()
+	}
+	if len(results) > s.batchMaxSize() {
+		return nil, badRequest(fmt.Sprintf("the filter matches more than %d users",
+			s.batchMaxSize())).Err()
+	}
+	// the matched versions are expected
+	users := make([]*pb.User, 0, len(results))
+	for _, res := range results {
+		users = append(users, &pb.User{
+			Id:      fmt.Sprint(res["_id"]),
+			Version: util.NextVersion(res) - 1,
+		})
+	}
+	batch, err := s.doBatch(ctx, "DeleteUsersByFilter", store_models.DELETE,
+		watcher_models.USER_DELETED, users, false, s.deleteItem)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.DeleteUsersByFilterResponse{
+		Matched:   uint64(len(results)),
+		Results:   batch.Results,
+		Succeeded: batch.Succeeded,
+		Failed:    batch.Failed,
+	}, nil
+}
+
+/*
+Do the batch of the users.
+The invalid users fail without the store request. The ordered batch stops
+at the first failed user, the next users fail with the SKIPPED reason.
+The failure of the whole batch is returned as the gRPC status.
+*/
+func (s *Server) doBatch(ctx context.Context, method string, act store_models.DoID,
+	eventType watcher_models.EventType, requests []*pb.User, ordered bool,
+	prepare batchItemFunc) (*pb.BatchUsersResponse, error) {
+	// check request
+	if len(requests) == 0 {
+		return nil, badRequest("the users are not set").Err()
+	}
+	if len(requests) > s.batchMaxSize() {
+		return nil, badRequest(fmt.Sprintf("the batch has more than %d users",
+			s.batchMaxSize())).Err()
+	}
+
+	responses := make([]*pb.UserResponse, len(requests))
+	users := make([]*models.User, 0, len(requests))
+	reqs := make([]store_models.IStoreDoRequest, 0, len(requests))
+	outbox := make([]store_models.OutboxFunc, 0, len(requests))
+	// index of the request of every store request
+	indexes := make([]int, 0, len(requests))
+	seen := make(map[string]bool, len(requests))
+	failed := false
+	for i, request := range requests {
+		if failed && ordered {
+			responses[i] = skipped(request.Id).userResponse(request.Id)
+			continue
+		}
+		user, failure := prepare(request)
+		if failure == nil && seen[request.Id] {
+			failure = badRequest("the user is repeated in the batch")
+		}
+		if failure != nil {
+			responses[i] = failure.userResponse(request.Id)
+			failed = true
+			continue
+		}
+		seen[request.Id] = true
+		users = append(users, user)
+		reqs = append(reqs, user)
+		// the deleted user has no update
+		update := user
+		if act == store_models.DELETE {
+			update = nil
+		}
+		outbox = append(outbox, s.outbox(ctx, eventType, request.Id, update, nil))
+		indexes = append(indexes, i)
+	}
+
+	if len(reqs) != 0 {
+		// the outbox is disabled
+		if s.EventSource != watcher_models.OUTBOX {
+			outbox = nil
+		}
+		results, err := s.Store.DoMany(ctx, act, reqs, ordered, outbox)
+		if err != nil {
+			return nil, s.storeError(method, "", err).Err()
+		}
+		for j, result := range results {
+			i := indexes[j]
+			id := requests[i].Id
+			if result.Err != nil {
+				responses[i] = s.storeError(method, id, result.Err).userResponse(id)
+				continue
+			}
+			var update *models.User
+			if act != store_models.DELETE {
+				update = users[j]
+			}
+			// inform
+			s.inform(ctx, eventType, id, result.Before, update, nil)
+			responses[i] = &pb.UserResponse{
+				Id:     id,
+				Status: http.StatusOK,
+			}
+			if act != store_models.DELETE {
+				responses[i].Version = util.NextVersion(result.Before)
+			}
+		}
+	}
+
+	batch := &pb.BatchUsersResponse{Results: responses}
+	for i, resp := range responses {
+		resp.Index = uint64(i)
+		if resp.Status == http.StatusOK {
+			batch.Succeeded++
+		} else {
+			batch.Failed++
+		}
+	}
+	s.Logger.Info(method+":", fmt.Sprintf("%d succeeded, %d failed",
+		batch.Succeeded, batch.Failed))
+	return batch, nil
+}
+
+// Check the modified user like ModifyUser does
+func (s *Server) modifyItem(request *pb.User) (*models.User, *apiError) {
+	if err := s.isValidRequest(request); err != nil {
+		return nil, badRequest(err)
+	}
+	if request.Version < 0 {
+		return nil, badRequest("the version must not be negative")
+	}
+	// copy pb request to the user struct
+	user := util.ConvertUserReq(request)
+	// check the user fields
+	if failure := s.validateUser(user); failure != nil {
+		return nil, failure
+	}
+	// set updated time
+	user.UpdatedAt = models.UpdatedAt(time.Now().UTC())
+	// the password is stored only as the hash
+	if err := s.hashPassword(user); err != nil {
+		s.Logger.Error("BatchModifyUsersError:", err.Error())
+		// send to the errors metric
+		s.ErrorsMetric.Add(1)
+		return nil, internal(err)
+	}
+	return user, nil
+}
+
+// Check the deleted user like DeleteUser does
+func (s *Server) deleteItem(request *pb.User) (*models.User, *apiError) {
+	if err := s.isValidRequest(request); err != nil {
+		return nil, badRequest(err)
+	}
+	if request.Version < 0 {
+		return nil, badRequest("the version must not be negative")
+	}
+	return &models.User{
+		ID:      models.ID(request.Id),
+		Version: models.Version(request.Version),
+	}, nil
+}
+
+func (s *Server) batchMaxSize() int {
+	if s.BatchMaxSize <= 0 {
+		return consts.GRPC_BATCH_MAX_SIZE
+	}
+	return s.BatchMaxSize
+}
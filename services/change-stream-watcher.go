@@ -0,0 +1,313 @@
+package services
+
+import (
+	"api/consts"
+	store_models "api/models/store"
+	watcher_models "api/models/watcher"
+	"api/util"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Error code of the resume token which is not in the oplog anymore
+const changeStreamHistoryLost = 286
+
+// ChangeStreamWatcher tails the users collection with the change stream
+// and publishes the events through the Publisher
+type ChangeStreamWatcher struct {
+	// the watched collection
+	Collection *mongo.Collection
+	// collection of the resume tokens
+	Tokens *mongo.Collection
+	// watcher publishing the events
+	Publisher watcher_models.IWatcher
+	// users are soft deleted, the deletes are the purges of
+	// the deleted users and aren't published
+	SoftDelete bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// closed when Listen returns
+	done chan struct{}
+}
+
+// Saved resume token of the watched collection
+type resumeTokenDoc struct {
+	// name of the watched collection
+	ID        string    `bson:"_id"`
+	Token     bson.Raw  `bson:"token"`
+	UpdatedAt time.Time `bson:"updated_at"`
+}
+
+// Event of the change stream
+type changeDoc struct {
+	// the resume token of the change
+	ID struct {
+		Data string `bson:"_data"`
+	} `bson:"_id"`
+	OperationType string              `bson:"operationType"`
+	ClusterTime   primitive.Timestamp `bson:"clusterTime"`
+	DocumentKey   struct {
+		ID interface{} `bson:"_id"`
+	} `bson:"documentKey"`
+	FullDocument      store_models.IStoreGetResponse `bson:"fullDocument"`
+	UpdateDescription struct {
+		UpdatedFields bson.M   `bson:"updatedFields"`
+		RemovedFields []string `bson:"removedFields"`
+	} `bson:"updateDescription"`
+}
+
+// Init new ChangeStreamWatcher.
+// The change stream needs the replica set.
+func NewChangeStreamWatcher(collection *mongo.Collection, tokens *mongo.Collection,
+	publisher watcher_models.IWatcher) *ChangeStreamWatcher {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ChangeStreamWatcher{
+		Collection: collection,
+		Tokens:     tokens,
+		Publisher:  publisher,
+		ctx:        ctx,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+}
+
+/*
+Start listen the changes.
+The func should run like a goroutine.
+The stream continues after the saved resume token, so the changes made
+while the service was stopped are published after the restart.
+The broken stream is opened again after WATCHER_REOPEN_DELAY.
+*/
+func (w *ChangeStreamWatcher) Listen() {
+	defer close(w.done)
+	go w.Publisher.Listen()
+
+	for {
+		err := w.watch()
+		if w.ctx.Err() != nil {
+			return
+		}
+		if isHistoryLost(err) {
+			// the changes after the token can't be read anymore
+			log.Printf("ChangeStreamWatcher: the resume token is lost, some changes are missed: %v", err)
+			if err := w.deleteToken(); err != nil {
+				log.Printf("ChangeStreamWatcher: failed to delete the resume token: %v", err)
+			}
+		} else {
+			log.Printf("ChangeStreamWatcher: the stream is broken: %v", err)
+		}
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-time.After(consts.WATCHER_REOPEN_DELAY):
+		}
+	}
+}
+
+// Stop the stream and close the Publisher
+func (w *ChangeStreamWatcher) Close() {
+	w.cancel()
+	select {
+	case <-w.done:
+	case <-time.After(consts.WATCHER_CLOSE_TIMEOUT):
+		log.Printf("ChangeStreamWatcher: close timeout")
+	}
+	w.Publisher.Close()
+}
+
+// Return the queue of the Publisher
+func (w *ChangeStreamWatcher) GetQueue() watcher_models.IEventQueue {
+	return w.Publisher.GetQueue()
+}
+
+// Publish the event through the Publisher
+func (w *ChangeStreamWatcher) Publish(ctx context.Context,
+	event *watcher_models.ChangeEvent) error {
+
+	return w.Publisher.Publish(ctx, event)
+}
+
+// Read the stream until the error.
+// The resume token is saved after the event is published.
+func (w *ChangeStreamWatcher) watch() error {
+	token, err := w.loadToken()
+	if err != nil {
+		return err
+	}
+	operations := bson.A{"insert", "update", "replace", "delete"}
+	if w.SoftDelete {
+		operations = bson.A{"insert", "update", "replace"}
+	}
+	pipeline := mongo.Pipeline{bson.D{{Key: "$match", Value: bson.D{
+		{Key: "operationType", Value: bson.D{{Key: "$in", Value: operations}}},
+	}}}}
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if token != nil {
+		opts.SetResumeAfter(token)
+	}
+
+	stream, err := w.Collection.Watch(w.ctx, pipeline, opts)
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+
+	for stream.Next(w.ctx) {
+		change := changeDoc{}
+		if err := stream.Decode(&change); err != nil {
+			return err
+		}
+		// the collection is dropped or renamed, start from now
+		if change.OperationType == "invalidate" {
+			if err := w.deleteToken(); err != nil {
+				return err
+			}
+			return fmt.Errorf("the stream is invalidated")
+		}
+		if !w.publish(streamEvent(&change)) {
+			return w.ctx.Err()
+		}
+		if err := w.saveToken(stream.ResumeToken()); err != nil {
+			// the event may be published again after the restart
+			log.Printf("ChangeStreamWatcher: failed to save the resume token: %v", err)
+		}
+	}
+	return stream.Err()
+}
+
+// Publish the event, retry until it's published or the watcher is closed
+func (w *ChangeStreamWatcher) publish(event *watcher_models.ChangeEvent) bool {
+	for attempts := 0; ; attempts++ {
+		ctx, cancel := context.WithTimeout(w.ctx, consts.WATCHER_PUBLISH_TIMEOUT)
+		err := w.Publisher.Publish(ctx, event)
+		cancel()
+		if err == nil {
+			return true
+		}
+		delay := backoff(attempts,
+			consts.WATCHER_RETRY_MIN_DELAY, consts.WATCHER_RETRY_MAX_DELAY)
+		log.Printf("ChangeStreamWatcher: failed to publish the event %s of the user %s, retry in %s: %v",
+			event.Type, event.UserID, delay, err)
+		select {
+		case <-w.ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (w *ChangeStreamWatcher) loadToken() (bson.Raw, error) {
+	doc := resumeTokenDoc{}
+	err := w.Tokens.FindOne(w.ctx,
+		bson.D{{Key: "_id", Value: w.Collection.Name()}}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the resume token: %v", err)
+	}
+	return doc.Token, nil
+}
+
+func (w *ChangeStreamWatcher) saveToken(token bson.Raw) error {
+	_, err := w.Tokens.ReplaceOne(w.ctx,
+		bson.D{{Key: "_id", Value: w.Collection.Name()}},
+		resumeTokenDoc{
+			ID:        w.Collection.Name(),
+			Token:     token,
+			UpdatedAt: time.Now().UTC(),
+		},
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+func (w *ChangeStreamWatcher) deleteToken() error {
+	_, err := w.Tokens.DeleteOne(context.Background(),
+		bson.D{{Key: "_id", Value: w.Collection.Name()}})
+	return err
+}
+
+func isHistoryLost(err error) bool {
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) {
+		return serverErr.HasErrorCode(changeStreamHistoryLost)
+	}
+	return false
+}
+
+// The event ID is made of the resume token,
+// so the change read again after the restart has the same ID
+func eventID(change *changeDoc) string {
+	sum := sha256.Sum256([]byte(change.ID.Data))
+	return hex.EncodeToString(sum[:16])
+}
+
+/*
+Convert the change to the event.
+The document before the change is not known, so the before snapshot is empty.
+The changed fields of the update are the top level fields of the update description,
+the replaced document has no changed fields.
+The update setting deleted_at is the soft delete, removing it is the restore.
+*/
+func streamEvent(change *changeDoc) *watcher_models.ChangeEvent {
+	event := &watcher_models.ChangeEvent{
+		ID:            eventID(change),
+		SchemaVersion: watcher_models.EVENT_SCHEMA_VERSION,
+		UserID:        fmt.Sprint(change.DocumentKey.ID),
+		Timestamp:     time.Unix(int64(change.ClusterTime.T), 0).UTC(),
+	}
+	switch change.OperationType {
+	case "insert":
+		event.Type = watcher_models.USER_ADDED
+	case "delete":
+		event.Type = watcher_models.USER_DELETED
+	default:
+		event.Type = watcher_models.USER_MODIFIED
+	}
+	if _, ok := change.UpdateDescription.UpdatedFields["deleted_at"]; ok {
+		event.Type = watcher_models.USER_DELETED
+	}
+	for _, key := range change.UpdateDescription.RemovedFields {
+		if key == "deleted_at" {
+			event.Type = watcher_models.USER_RESTORED
+		}
+	}
+	if change.FullDocument != nil {
+		snapshot := watcher_models.UserSnapshot(util.PublicUser(change.FullDocument))
+		// the soft deleted user is the last known state
+		if event.Type == watcher_models.USER_DELETED {
+			event.Before = snapshot
+		} else {
+			event.After = snapshot
+		}
+	}
+
+	changed := make(map[string]bool)
+	for key := range change.UpdateDescription.UpdatedFields {
+		changed[strings.SplitN(key, ".", 2)[0]] = true
+	}
+	for _, key := range change.UpdateDescription.RemovedFields {
+		changed[strings.SplitN(key, ".", 2)[0]] = true
+	}
+	delete(changed, "updated_at")
+	delete(changed, "version")
+	for key := range changed {
+		event.ChangedFields = append(event.ChangedFields, key)
+	}
+	sort.Strings(event.ChangedFields)
+	return event
+}
@@ -0,0 +1,130 @@
+package services
+
+import (
+	"api/consts"
+	metric_models "api/models/metric"
+	watcher_models "api/models/watcher"
+	"context"
+	"sync"
+)
+
+// EventHub sends the published events to all subscribers.
+// Every subscriber has the bounded buffer, the subscriber
+// with the full buffer is dropped, so it can't block the others.
+type EventHub struct {
+	// size of the buffer of one subscriber
+	BufferSize int
+	// number of the subscribers metric
+	SubscribersMetric metric_models.IMetricGauge
+
+	mu          sync.Mutex
+	subscribers map[*Subscription]struct{}
+	closed      bool
+}
+
+// Subscription of the EventHub
+type Subscription struct {
+	hub    *EventHub
+	events chan *watcher_models.ChangeEvent
+	done   chan struct{}
+	err    error
+}
+
+// Init new EventHub, WATCH_BUFFER_SIZE is used by default
+func NewEventHub(bufferSize int, subscribers metric_models.IMetricGauge) *EventHub {
+	if bufferSize <= 0 {
+		bufferSize = consts.WATCH_BUFFER_SIZE
+	}
+	return &EventHub{
+		BufferSize:        bufferSize,
+		SubscribersMetric: subscribers,
+		subscribers:       make(map[*Subscription]struct{}),
+	}
+}
+
+// Add the new subscriber, it gets the events published after the call
+func (h *EventHub) Subscribe() (watcher_models.ISubscription, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil, watcher_models.ErrHubClosed
+	}
+	sub := &Subscription{
+		hub:    h,
+		events: make(chan *watcher_models.ChangeEvent, h.BufferSize),
+		done:   make(chan struct{}),
+	}
+	h.subscribers[sub] = struct{}{}
+	h.updateSubscribers()
+	return sub, nil
+}
+
+// Send the event to all subscribers without waiting
+func (h *EventHub) Publish(ctx context.Context,
+	event *watcher_models.ChangeEvent) error {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			h.drop(sub, watcher_models.ErrSlowSubscriber)
+		}
+	}
+	return nil
+}
+
+// Drop all subscribers
+func (h *EventHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for sub := range h.subscribers {
+		h.drop(sub, watcher_models.ErrHubClosed)
+	}
+}
+
+// Remove the subscriber, the mutex must be locked
+func (h *EventHub) drop(sub *Subscription, err error) {
+	if _, ok := h.subscribers[sub]; !ok {
+		return
+	}
+	delete(h.subscribers, sub)
+	sub.err = err
+	close(sub.done)
+	h.updateSubscribers()
+}
+
+func (h *EventHub) updateSubscribers() {
+	if h.SubscribersMetric != nil {
+		h.SubscribersMetric.Set(float64(len(h.subscribers)))
+	}
+}
+
+// Events of the subscriber
+func (s *Subscription) Events() <-chan *watcher_models.ChangeEvent {
+	return s.events
+}
+
+// Closed when the subscriber is dropped
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Reason of the drop, nil if the subscriber isn't dropped
+func (s *Subscription) Err() error {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	return s.err
+}
+
+// Unsubscribe
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.drop(s, nil)
+}
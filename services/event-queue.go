@@ -0,0 +1,288 @@
+package services
+
+import (
+	metric_models "api/models/metric"
+	watcher_models "api/models/watcher"
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// EventQueue is the bounded queue of the change events
+// with the policy for the full queue
+type EventQueue struct {
+	Size   int
+	Policy watcher_models.OverflowPolicy
+	// max wait for the free place by the BLOCK policy
+	PushTimeout time.Duration
+	// queue depth metric
+	DepthMetric metric_models.IMetricGauge
+	// dropped events metric
+	DropsMetric metric_models.IMetricCount
+
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	events   []*watcher_models.ChangeEvent
+	closed   bool
+
+	// events spilled to the disk, one JSON event per line
+	spillWriter *os.File
+	spillFile   *os.File
+	spillReader *bufio.Reader
+	spilled     int
+}
+
+/*
+Init new EventQueue.
+The spillPath is used only by the SPILL policy, events left
+in the file by the previous run are queued first.
+The pushTimeout is used only by the BLOCK policy.
+*/
+func NewEventQueue(size int, policy watcher_models.OverflowPolicy,
+	spillPath string, pushTimeout time.Duration, depth metric_models.IMetricGauge,
+	drops metric_models.IMetricCount) (*EventQueue, error) {
+
+	if size <= 0 {
+		return nil, fmt.Errorf("the queue size must be positive")
+	}
+	q := &EventQueue{
+		Size:        size,
+		Policy:      policy,
+		PushTimeout: pushTimeout,
+		DepthMetric: depth,
+		DropsMetric: drops,
+		events:      make([]*watcher_models.ChangeEvent, 0, size),
+	}
+	q.notEmpty = sync.NewCond(&q.mu)
+	q.notFull = sync.NewCond(&q.mu)
+
+	switch policy {
+	case watcher_models.BLOCK, watcher_models.DROP_OLDEST:
+	case watcher_models.SPILL:
+		if err := q.openSpill(spillPath); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown overflow policy: %s", policy)
+	}
+	q.updateDepth()
+	return q, nil
+}
+
+// Put the event to the queue according to the policy.
+// The BLOCK policy drops the event when the context is done
+// or the timeout expires before the free place.
+func (q *EventQueue) Push(ctx context.Context, event *watcher_models.ChangeEvent) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return watcher_models.ErrQueueClosed
+	}
+	switch q.Policy {
+	case watcher_models.SPILL:
+		// keep the order while the spilled events exist
+		if q.spilled > 0 || len(q.events) >= q.Size {
+			if err := q.spill(event); err != nil {
+				return err
+			}
+			q.updateDepth()
+			q.notEmpty.Signal()
+			return nil
+		}
+	case watcher_models.DROP_OLDEST:
+		if len(q.events) >= q.Size {
+			q.events = q.events[1:]
+			q.drop()
+		}
+	default:
+		if len(q.events) >= q.Size {
+			if err := q.waitNotFull(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	q.events = append(q.events, event)
+	q.updateDepth()
+	q.notEmpty.Signal()
+	return nil
+}
+
+// Wait for the free place, the lock is held
+func (q *EventQueue) waitNotFull(ctx context.Context) error {
+	if q.PushTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, q.PushTimeout)
+		defer cancel()
+	}
+	// the cond can't wait for the context, so it's woken up
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			q.mu.Lock()
+			q.notFull.Broadcast()
+			q.mu.Unlock()
+		case <-stop:
+		}
+	}()
+
+	for len(q.events) >= q.Size && !q.closed && ctx.Err() == nil {
+		q.notFull.Wait()
+	}
+	if q.closed {
+		return watcher_models.ErrQueueClosed
+	}
+	if len(q.events) >= q.Size {
+		q.drop()
+		return fmt.Errorf("the event queue is full: %w", ctx.Err())
+	}
+	return nil
+}
+
+// Get the next event, wait for it if the queue is empty.
+// After Close the events in the memory are still returned,
+// the spilled events are kept for the next run.
+func (q *EventQueue) Pop() (*watcher_models.ChangeEvent, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		for len(q.events) == 0 && q.spilled == 0 && !q.closed {
+			q.notEmpty.Wait()
+		}
+		if len(q.events) == 0 && q.spilled > 0 && !q.closed {
+			q.unspill()
+		}
+		if len(q.events) != 0 {
+			break
+		}
+		if q.closed {
+			return nil, false
+		}
+	}
+	event := q.events[0]
+	q.events[0] = nil
+	q.events = q.events[1:]
+	q.updateDepth()
+	q.notFull.Signal()
+	return event, true
+}
+
+// Number of the queued events
+func (q *EventQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.events) + q.spilled
+}
+
+// Close the queue, waiting senders and receivers are released
+func (q *EventQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+	if q.spillWriter != nil {
+		q.spillWriter.Close()
+		q.spillFile.Close()
+	}
+}
+
+// Open the spill file and count the events left by the previous run
+func (q *EventQueue) openSpill(path string) (err error) {
+	q.spillWriter, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open the spill file: %v", err)
+	}
+	q.spillFile, err = os.Open(path)
+	if err != nil {
+		q.spillWriter.Close()
+		return fmt.Errorf("failed to open the spill file: %v", err)
+	}
+	scanner := bufio.NewScanner(q.spillFile)
+	scanner.Buffer(nil, 1<<24)
+	for scanner.Scan() {
+		q.spilled++
+	}
+	if err := scanner.Err(); err != nil {
+		q.spillWriter.Close()
+		q.spillFile.Close()
+		return fmt.Errorf("failed to read the spill file: %v", err)
+	}
+	if _, err := q.spillFile.Seek(0, io.SeekStart); err != nil {
+		q.spillWriter.Close()
+		q.spillFile.Close()
+		return fmt.Errorf("failed to read the spill file: %v", err)
+	}
+	q.spillReader = bufio.NewReader(q.spillFile)
+	return nil
+}
+
+// Write the event to the spill file
+func (q *EventQueue) spill(event *watcher_models.ChangeEvent) error {
+	data, err := event.Marshal()
+	if err != nil {
+		return err
+	}
+	if _, err := q.spillWriter.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to spill the event: %v", err)
+	}
+	q.spilled++
+	return nil
+}
+
+// Move the spilled events to the memory up to the queue size.
+// The file is truncated when all events are read.
+func (q *EventQueue) unspill() {
+	for q.spilled > 0 && len(q.events) < q.Size {
+		line, err := q.spillReader.ReadBytes('\n')
+		if err != nil {
+			log.Printf("EventQueue: failed to read the spill file: %v", err)
+			q.spilled = 0
+			break
+		}
+		q.spilled--
+		event := &watcher_models.ChangeEvent{}
+		if err := json.Unmarshal(line, event); err != nil {
+			log.Printf("EventQueue: failed to decode the spilled event: %v", err)
+			q.drop()
+			continue
+		}
+		q.events = append(q.events, event)
+	}
+	if q.spilled > 0 {
+		return
+	}
+	// all events are read, start the file again
+	if err := q.spillWriter.Truncate(0); err != nil {
+		log.Printf("EventQueue: failed to truncate the spill file: %v", err)
+	}
+	if _, err := q.spillFile.Seek(0, io.SeekStart); err != nil {
+		log.Printf("EventQueue: failed to rewind the spill file: %v", err)
+	}
+	q.spillReader.Reset(q.spillFile)
+}
+
+func (q *EventQueue) drop() {
+	if q.DropsMetric != nil {
+		q.DropsMetric.Add(1)
+	}
+}
+
+func (q *EventQueue) updateDepth() {
+	if q.DepthMetric != nil {
+		q.DepthMetric.Set(float64(len(q.events) + q.spilled))
+	}
+}
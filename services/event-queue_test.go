@@ -0,0 +1,63 @@
+package services
+
+import (
+	watcher_models "api/models/watcher"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEventQueueBlockPush(t *testing.T) {
+	queue, err := NewEventQueue(1, watcher_models.BLOCK, "", 50*time.Millisecond, nil, nil)
+	if err != nil {
+		t.Fatalf("NewEventQueue error: %v", err)
+	}
+	defer queue.Close()
+	first := userEvent(watcher_models.USER_ADDED, "user-1", 0)
+	if err := queue.Push(context.Background(), first); err != nil {
+		t.Fatalf("Push error: %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		wantErr error
+	}{
+		{name: "timeout", ctx: context.Background(), wantErr: context.DeadlineExceeded},
+		{name: "cancelled request", ctx: cancelled, wantErr: context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			err := queue.Push(tt.ctx, userEvent(watcher_models.USER_MODIFIED, "user-1", 1))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Push error = %v, want %v", err, tt.wantErr)
+			}
+			if waited := time.Since(start); waited > time.Second {
+				t.Errorf("Push waited %v for the full queue", waited)
+			}
+		})
+	}
+	if queue.Len() != 1 {
+		t.Errorf("queue has %d events, want the first one", queue.Len())
+	}
+
+	// the free place is taken by the waiting sender
+	next := userEvent(watcher_models.USER_DELETED, "user-1", 2)
+	pushed := make(chan error)
+	go func() {
+		pushed <- queue.Push(context.Background(), next)
+	}()
+	if event, ok := queue.Pop(); !ok || event != first {
+		t.Fatalf("Pop = %v, %t, want the first event", event, ok)
+	}
+	if err := <-pushed; err != nil {
+		t.Fatalf("Push error: %v", err)
+	}
+	if event, ok := queue.Pop(); !ok || event != next {
+		t.Errorf("Pop = %v, %t, want the next event", event, ok)
+	}
+}
@@ -0,0 +1,69 @@
+package services
+
+import (
+	"api/consts"
+	watcher_models "api/models/watcher"
+	"context"
+	"fmt"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Writer of the kafka messages, the mock broker can replace it
+type KafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+type KafkaPublisher struct {
+	Brokers []string
+	Topic   string
+	Writer  KafkaWriter
+}
+
+/*
+Init new KafkaPublisher.
+Messages are partitioned by the hash of the key, the key is the user ID,
+so the events of the user are in one partition in order.
+*/
+func NewKafkaPublisher(brokers []string, topic string) (*KafkaPublisher, error) {
+	if len(brokers) == 0 || topic == "" {
+		return nil, fmt.Errorf("kafka: the brokers and the topic must be set")
+	}
+	return &KafkaPublisher{
+		Brokers: brokers,
+		Topic:   topic,
+		Writer: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			// events are published one by one
+			BatchTimeout: consts.KAFKA_BATCH_TIMEOUT,
+		},
+	}, nil
+}
+
+// Close the writer, pending messages are flushed
+func (p *KafkaPublisher) Close() {
+	p.Writer.Close()
+}
+
+// Send the event to the topic and wait for the acknowledgement of all replicas.
+// The headers are the same as the pub-sub attributes.
+func (p *KafkaPublisher) Publish(ctx context.Context,
+	event *watcher_models.ChangeEvent) error {
+
+	data, err := event.Marshal()
+	if err != nil {
+		return err
+	}
+	msg := kafka.Message{
+		Key:   []byte(event.UserID),
+		Value: data,
+	}
+	for key, value := range eventAttributes(event) {
+		msg.Headers = append(msg.Headers, kafka.Header{Key: key, Value: []byte(value)})
+	}
+	return p.Writer.WriteMessages(ctx, msg)
+}
@@ -0,0 +1,212 @@
+package services
+
+import (
+	watcher_models "api/models/watcher"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/metadata"
+	"github.com/segmentio/kafka-go/protocol/produce"
+)
+
+// Record written to the partition of the mock broker
+type brokerRecord struct {
+	key     string
+	value   []byte
+	headers map[string]string
+}
+
+/*
+Broker of one topic in the memory. It answers the metadata and produce
+requests of the kafka.Writer, so the writer chooses the partitions
+with its balancer like with the real broker.
+*/
+type mockKafkaBroker struct {
+	partitions int
+	// error code of the produce response
+	errorCode kafka.Error
+
+	mu      sync.Mutex
+	records map[int][]brokerRecord
+}
+
+func (b *mockKafkaBroker) RoundTrip(ctx context.Context, addr net.Addr,
+	req kafka.Request) (kafka.Response, error) {
+
+	switch req := req.(type) {
+	case *metadata.Request:
+		res := &metadata.Response{
+			Brokers: []metadata.ResponseBroker{{NodeID: 1, Host: "localhost", Port: 9092}},
+		}
+		for _, name := range req.TopicNames {
+			topic := metadata.ResponseTopic{Name: name}
+			for i := 0; i < b.partitions; i++ {
+				topic.Partitions = append(topic.Partitions,
+					metadata.ResponsePartition{PartitionIndex: int32(i), LeaderID: 1})
+			}
+			res.Topics = append(res.Topics, topic)
+		}
+		return res, nil
+	case *produce.Request:
+		res := &produce.Response{}
+		for _, t := range req.Topics {
+			topic := produce.ResponseTopic{Topic: t.Topic}
+			for _, p := range t.Partitions {
+				if b.errorCode == 0 {
+					if err := b.write(int(p.Partition), p.RecordSet.Records); err != nil {
+						return nil, err
+					}
+				}
+				topic.Partitions = append(topic.Partitions, produce.ResponsePartition{
+					Partition: p.Partition,
+					ErrorCode: int16(b.errorCode),
+				})
+			}
+			res.Topics = append(res.Topics, topic)
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("unexpected request %T", req)
+}
+
+// Append the records to the partition
+func (b *mockKafkaBroker) write(partition int, records protocol.RecordReader) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.records == nil {
+		b.records = make(map[int][]brokerRecord)
+	}
+	for {
+		rec, err := records.ReadRecord()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		key, err := protocol.ReadAll(rec.Key)
+		if err != nil {
+			return err
+		}
+		value, err := protocol.ReadAll(rec.Value)
+		if err != nil {
+			return err
+		}
+		headers := make(map[string]string)
+		for _, h := range rec.Headers {
+			headers[h.Key] = string(h.Value)
+		}
+		b.records[partition] = append(b.records[partition],
+			brokerRecord{key: string(key), value: value, headers: headers})
+	}
+}
+
+// Kafka publisher writing to the mock broker
+func newMockKafkaPublisher(t *testing.T, broker *mockKafkaBroker) *KafkaPublisher {
+	p, err := NewKafkaPublisher([]string{"localhost:9092"}, "users.events")
+	if err != nil {
+		t.Fatalf("NewKafkaPublisher error: %v", err)
+	}
+	writer := p.Writer.(*kafka.Writer)
+	writer.Transport = broker
+	writer.MaxAttempts = 1
+	return p
+}
+
+func TestKafkaPublisherKeyOrder(t *testing.T) {
+	broker := &mockKafkaBroker{partitions: 3}
+	p := newMockKafkaPublisher(t, broker)
+	defer p.Close()
+
+	// the events of the users are interleaved, the number of the users
+	// isn't a multiple of the partitions, so the round robin would split them
+	users := []string{"user-1", "user-2", "user-3", "user-4", "user-5"}
+	types := []watcher_models.EventType{watcher_models.USER_ADDED,
+		watcher_models.USER_MODIFIED, watcher_models.USER_DELETED}
+	sent := make(map[string][]*watcher_models.ChangeEvent)
+	for i, typ := range types {
+		for j, userID := range users {
+			event := userEvent(typ, userID, i*len(users)+j)
+			if err := p.Publish(context.Background(), event); err != nil {
+				t.Fatalf("Publish error: %v", err)
+			}
+			sent[userID] = append(sent[userID], event)
+		}
+	}
+
+	// the hash of the key puts all events of the user to one partition in order
+	received := make(map[string][]*watcher_models.ChangeEvent)
+	partitionOf := make(map[string]int)
+	for partition, records := range broker.records {
+		for _, rec := range records {
+			if first, ok := partitionOf[rec.key]; ok && first != partition {
+				t.Errorf("events of %s are in the partitions %d and %d",
+					rec.key, first, partition)
+			}
+			partitionOf[rec.key] = partition
+			event := &watcher_models.ChangeEvent{}
+			if err := json.Unmarshal(rec.value, event); err != nil {
+				t.Fatalf("the record isn't the JSON event: %v", err)
+			}
+			if event.UserID != rec.key {
+				t.Errorf("key = %q, want the user ID %q", rec.key, event.UserID)
+			}
+			if !reflect.DeepEqual(rec.headers, eventAttributes(event)) {
+				t.Errorf("headers = %v, want %v", rec.headers, eventAttributes(event))
+			}
+			received[rec.key] = append(received[rec.key], event)
+		}
+	}
+	if !reflect.DeepEqual(received, sent) {
+		t.Errorf("received events = %v, want %v", received, sent)
+	}
+	// the users are spread over the partitions
+	if len(broker.records) < 2 {
+		t.Errorf("the events are written to %d partitions, want more than one",
+			len(broker.records))
+	}
+}
+
+func TestKafkaPublisherPublishError(t *testing.T) {
+	broker := &mockKafkaBroker{partitions: 1, errorCode: kafka.NotEnoughReplicas}
+	p := newMockKafkaPublisher(t, broker)
+	defer p.Close()
+
+	// the writer reports the error of every message
+	err := p.Publish(context.Background(), userEvent(watcher_models.USER_ADDED, "user-1", 0))
+	var writeErrs kafka.WriteErrors
+	if !errors.As(err, &writeErrs) || len(writeErrs) != 1 ||
+		!errors.Is(writeErrs[0], kafka.NotEnoughReplicas) {
+		t.Errorf("Publish error = %v, want %v", err, kafka.NotEnoughReplicas)
+	}
+	if len(broker.records) != 0 {
+		t.Errorf("the rejected event is written: %v", broker.records)
+	}
+}
+
+func TestNewKafkaPublisherConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		brokers []string
+		topic   string
+	}{
+		{name: "no brokers", topic: "users.events"},
+		{name: "no topic", brokers: []string{"localhost:9092"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewKafkaPublisher(tt.brokers, tt.topic); err == nil {
+				t.Error("NewKafkaPublisher error = nil, want the config error")
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+package services
+
+import (
+	"api/consts"
+	store_models "api/models/store"
+	"api/util"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The write of the batch failed and the transaction is aborted
+var errBatchWrite = errors.New("the write of the batch failed")
+
+// Code of the conversion error failing the update of the other version
+const conversionFailure = 241
+
+/*
+Do MODIFY or DELETE of the batch with one bulk write.
+The documents are read first: the missing documents and the documents
+which don't have the expected version fail without the write,
+the writes are matched by the read version.
+If the outbox funcs are set, the batch and the outbox messages are written
+in the transaction. The failed write aborts the whole transaction,
+so the batch is repeated without the failed requests.
+*/
+func (ms *MongoStore) DoMany(ctx context.Context, act store_models.DoID,
+	reqs []store_models.IStoreDoRequest, ordered bool,
+	outbox []store_models.OutboxFunc) ([]store_models.BatchResult, error) {
+
+	if act != store_models.MODIFY && act != store_models.DELETE {
+		return nil, store_models.NewError(store_models.ErrInvalid,
+			fmt.Errorf("wrong DoID type of the batch"))
+	}
+	ctx, cancel := withTimeout(ctx, ms.WriteTimeout)
+	defer cancel()
+	if outbox == nil {
+		results, _, err := ms.doMany(ctx, act, reqs, ordered)
+		return results, err
+	}
+
+	session, err := ms.Client.StartSession()
+	if err != nil {
+		return nil, storeError(err)
+	}
+	defer session.EndSession(ctx)
+
+	results := make([]store_models.BatchResult, len(reqs))
+	// indexes of the requests which aren't done yet
+	pending := make([]int, len(reqs))
+	for i := range pending {
+		pending[i] = i
+	}
+	for len(pending) > 0 {
+		batch := make([]store_models.IStoreDoRequest, len(pending))
+		for j, i := range pending {
+			batch[j] = reqs[i]
+		}
+		var round []store_models.BatchResult
+		// the func is repeated on the transient transaction errors
+		_, err := session.WithTransaction(ctx,
+			func(sc mongo.SessionContext) (interface{}, error) {
+				var (
+					writeFailed bool
+					err         error
+				)
+				round, writeFailed, err = ms.doMany(sc, act, batch, ordered)
+				if err != nil {
+					return nil, err
+				}
+				if writeFailed {
+					return nil, errBatchWrite
+				}
+				for j, result := range round {
+					if result.Err != nil || outbox[pending[j]] == nil {
+						continue
+					}
+					message, err := outbox[pending[j]](result.Before)
+					if err != nil {
+						return nil, err
+					}
+					if err := ms.insertOutbox(sc, message); err != nil {
+						return nil, err
+					}
+				}
+				return nil, nil
+			})
+		if err != nil && !errors.Is(err, errBatchWrite) {
+			return nil, storeError(err)
+		}
+		aborted := err != nil
+		next := make([]int, 0, len(pending))
+		for j, result := range round {
+			// the changes of the aborted transaction are repeated
+			if aborted && result.Err == nil {
+				next = append(next, pending[j])
+				continue
+			}
+			results[pending[j]] = result
+		}
+		pending = next
+	}
+	return results, nil
+}
+
+/*
+Do the batch with one bulk write, writeFailed is set if the write of any request failed.
+The update of the document changed by the other request after the read fails
+with the write error of its index, so every request gets its own result.
+The write of the document deleted after the read matches nothing,
+the counts of the bulk write tell if it happened.
+*/
+func (ms *MongoStore) doMany(ctx context.Context, act store_models.DoID,
+	reqs []store_models.IStoreDoRequest, ordered bool) (
+	results []store_models.BatchResult, writeFailed bool, err error) {
+
+	befores, err := ms.findMany(ctx, reqs)
+	if err != nil {
+		return nil, false, err
+	}
+
+	results = make([]store_models.BatchResult, len(reqs))
+	models := make([]mongo.WriteModel, 0, len(reqs))
+	// index of the request of every write model
+	indexes := make([]int, 0, len(reqs))
+	failed := false
+	for i, req := range reqs {
+		if failed && ordered {
+			results[i].Err = store_models.ErrSkipped
+			continue
+		}
+		before := befores[fmt.Sprint(req.GetID())]
+		model, err := ms.writeModel(act, req, before)
+		if err != nil {
+			results[i].Err = err
+			failed = true
+			continue
+		}
+		results[i].Before = before
+		models = append(models, model)
+		indexes = append(indexes, i)
+	}
+	if len(models) == 0 {
+		return results, false, nil
+	}
+
+	res, err := ms.Collection.BulkWrite(ctx, models,
+		options.BulkWrite().SetOrdered(ordered))
+	var bulkErr mongo.BulkWriteException
+	if err != nil && (!errors.As(err, &bulkErr) || len(bulkErr.WriteErrors) == 0) {
+		return nil, false, storeError(err)
+	}
+	// the models which are written
+	written := make([]bool, len(models))
+	for j := range written {
+		written[j] = true
+	}
+	for _, writeErr := range bulkErr.WriteErrors {
+		i := indexes[writeErr.Index]
+		results[i] = store_models.BatchResult{Err: storeError(writeErr)}
+		if writeErr.Code == conversionFailure {
+			results[i].Err = store_models.NewError(store_models.ErrVersionMismatch,
+				fmt.Errorf("the user %v is changed by the other request", reqs[i].GetID()))
+		}
+		written[writeErr.Index] = false
+		writeFailed = true
+	}
+	if ordered && writeFailed {
+		// the writes after the failed one aren't done
+		for j := bulkErr.WriteErrors[0].Index + 1; j < len(models); j++ {
+			results[indexes[j]] = store_models.BatchResult{Err: store_models.ErrSkipped}
+			written[j] = false
+		}
+	}
+	count := int64(0)
+	for _, ok := range written {
+		if ok {
+			count++
+		}
+	}
+	if res == nil || res.MatchedCount+res.DeletedCount >= count {
+		return results, writeFailed, nil
+	}
+
+	// find the documents deleted by the other request
+	deleted, err := ms.findDeleted(ctx, act, reqs, indexes, written)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, j := range deleted {
+		i := indexes[j]
+		results[i] = store_models.BatchResult{Err: store_models.NewError(
+			store_models.ErrVersionMismatch,
+			fmt.Errorf("the user %v is changed by the other request", reqs[i].GetID()))}
+		writeFailed = true
+	}
+	return results, writeFailed, nil
+}
+
+/*
+Return the indexes of the written models which matched nothing.
+The update of the missing document matches nothing, the delete
+of the document which still exists matches nothing too.
+The deleted document doesn't come back, so the check is exact.
+*/
+func (ms *MongoStore) findDeleted(ctx context.Context, act store_models.DoID,
+	reqs []store_models.IStoreDoRequest, indexes []int, written []bool) ([]int, error) {
+
+	ids := make(bson.A, 0, len(indexes))
+	for j, i := range indexes {
+		if written[j] {
+			ids = append(ids, reqs[i].GetID())
+		}
+	}
+	cur, err := ms.Collection.Find(ctx,
+		bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}},
+		options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, storeError(err)
+	}
+	docs := []store_models.IStoreGetResponse{}
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, storeError(err)
+	}
+	exists := make(map[string]bool, len(docs))
+	for _, doc := range docs {
+		exists[fmt.Sprint(doc["_id"])] = true
+	}
+	// the hard delete is the only write removing the document
+	deletes := act == store_models.DELETE && !ms.SoftDelete
+	var unmatched []int
+	for j, i := range indexes {
+		if written[j] && exists[fmt.Sprint(reqs[i].GetID())] == deletes {
+			unmatched = append(unmatched, j)
+		}
+	}
+	return unmatched, nil
+}
+
+// Create the write of the request matched by the version of the read document
+func (ms *MongoStore) writeModel(act store_models.DoID,
+	req store_models.IStoreDoRequest,
+	before store_models.IStoreGetResponse) (mongo.WriteModel, error) {
+
+	if before == nil {
+		return nil, store_models.NewError(store_models.ErrNotFound,
+			fmt.Errorf(consts.STORE_KEY_NOT_FOUND, req.GetID()))
+	}
+	version := util.NextVersion(before) - 1
+	if v, ok := req.(store_models.IVersionedRequest); ok &&
+		v.GetVersion() > 0 && v.GetVersion() != version {
+		return nil, store_models.NewError(store_models.ErrVersionMismatch,
+			fmt.Errorf("the user %v doesn't have the version %d", req.GetID(), v.GetVersion()))
+	}
+	switch {
+	case act == store_models.MODIFY:
+		set, err := setDoc(req)
+		if err != nil {
+			return nil, err
+		}
+		return versionedUpdate(req.GetID(), version, set), nil
+	case ms.SoftDelete:
+		return versionedUpdate(req.GetID(), version, softDeleteFields()), nil
+	}
+	// the documents created before the versions have no version
+	match := bson.E{Key: "version", Value: version}
+	if version == 0 {
+		match.Value = bson.D{{Key: "$exists", Value: false}}
+	}
+	filter := append(ms.idFilter(req.GetID()), match)
+	return mongo.NewDeleteOneModel().SetFilter(filter), nil
+}
+
+/*
+Create the update of the document which has the version.
+The update pipeline increases the version or fails with the conversion
+error on the other version, so the mismatch is the write error of the request.
+Every change increases the version, the soft delete too.
+The values are literals, so they aren't read as the field paths.
+*/
+func versionedUpdate(id interface{}, version int64, set bson.M) mongo.WriteModel {
+	fields := bson.D{{Key: "version", Value: bson.D{{Key: "$cond", Value: bson.A{
+		bson.D{{Key: "$eq", Value: bson.A{
+			bson.D{{Key: "$ifNull", Value: bson.A{"$version", 0}}}, version}}},
+		version + 1,
+		bson.D{{Key: "$toInt", Value: "the version is changed"}},
+	}}}}}
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		if key != "_id" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fields = append(fields, bson.E{Key: key,
+			Value: bson.D{{Key: "$literal", Value: set[key]}}})
+	}
+	return mongo.NewUpdateOneModel().
+		SetFilter(bson.D{{Key: "_id", Value: id}}).
+		SetUpdate(bson.A{bson.D{{Key: "$set", Value: fields}}})
+}
+
+// Read the documents of the requests by the ids,
+// the soft deleted documents are skipped
+func (ms *MongoStore) findMany(ctx context.Context,
+	reqs []store_models.IStoreDoRequest) (map[string]store_models.IStoreGetResponse, error) {
+
+	ids := make(bson.A, 0, len(reqs))
+	for _, req := range reqs {
+		ids = append(ids, req.GetID())
+	}
+	filter := bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}}
+	if ms.SoftDelete {
+		filter = append(filter, notDeleted)
+	}
+	cur, err := ms.Collection.Find(ctx, filter)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	docs := []store_models.IStoreGetResponse{}
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, storeError(err)
+	}
+	found := make(map[string]store_models.IStoreGetResponse, len(docs))
+	for _, doc := range docs {
+		found[fmt.Sprint(doc["_id"])] = doc
+	}
+	return found, nil
+}
@@ -5,20 +5,60 @@ import (
 	store_models "api/models/store"
 	"api/util"
 	"context"
+	"errors"
 	"fmt"
+	"regexp"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var ctx = context.TODO()
+// Unique indexes of the users collection and their fields
+var uniqueIndexes = map[string]string{
+	"_id_":            "_id",
+	"email_unique":    "email",
+	"nickname_unique": "nickname",
+}
+
+// Get the index name from the duplicate key error message
+var dupKeyIndexRegexp = regexp.MustCompile(`index: (\S+) dup key`)
 
 // MongoStore contains mongo.Client
 type MongoStore struct {
 	Client     *mongo.Client
 	Database   *mongo.Database
 	Collection *mongo.Collection
+	// outbox of the change events
+	Outbox *mongo.Collection
+	// registered webhooks and their failed deliveries
+	Webhooks    *mongo.Collection
+	DeadLetters *mongo.Collection
+	// default timeouts of one operation
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// DELETE sets deleted_at instead of deleting the document
+	SoftDelete bool
+}
+
+// Condition of the documents which aren't soft deleted
+var notDeleted = bson.E{Key: "deleted_at",
+	Value: bson.D{{Key: "$exists", Value: false}}}
+
+// Document of the outbox collection
+type outboxDoc struct {
+	ID string `bson:"_id"`
+	// the JSON message
+	Message  string `bson:"message"`
+	Attempts int    `bson:"attempts"`
+	// the entry is due from this time, unset after the delivery
+	NextAttemptAt time.Time `bson:"next_attempt_at,omitempty"`
+	CreatedAt     time.Time `bson:"created_at"`
+	DeliveredAt   time.Time `bson:"delivered_at,omitempty"`
+	// the entry which can't be delivered
+	DeadAt time.Time `bson:"dead_at,omitempty"`
+	Error  string    `bson:"error,omitempty"`
 }
 
 // NewMongoStore creates a new Client and then initializes it using the Connect method.
@@ -57,127 +97,732 @@ func NewMongoStore(ctx context.Context,
 	// set table
 	collection := db.Collection(cfg.Table)
 
-	return &MongoStore{
-		Client:     client,
-		Database:   db,
-		Collection: collection,
-	}, nil
+	outboxTable := cfg.OutboxTable
+	if outboxTable == "" {
+		outboxTable = consts.STORE_OUTBOX_TABLE
+	}
+
+	webhooksTable := cfg.WebhooksTable
+	if webhooksTable == "" {
+		webhooksTable = consts.STORE_WEBHOOKS_TABLE
+	}
+	deadLettersTable := cfg.DeadLettersTable
+	if deadLettersTable == "" {
+		deadLettersTable = consts.STORE_DEAD_LETTERS_TABLE
+	}
+
+	ms = &MongoStore{
+		Client:       client,
+		Database:     db,
+		Collection:   collection,
+		Outbox:       db.Collection(outboxTable),
+		Webhooks:     db.Collection(webhooksTable),
+		DeadLetters:  db.Collection(deadLettersTable),
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		SoftDelete:   cfg.SoftDelete,
+	}
+	// create unique indexes
+	if err = ms.createIndexes(ctx); err != nil {
+		return nil, err
+	}
+	// the collections can't be created inside the transaction,
+	// so the outbox indexes are created here too
+	if err = ms.createOutboxIndexes(ctx); err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+/*
+Create unique indexes of the users fields.
+The users without the field are not indexed. The field is unique together
+with deleted_at: the users which aren't deleted have no deleted_at,
+so the field of the soft deleted user can be used by the other user.
+The index of deleted_at is used by the purge of the deleted users.
+*/
+func (ms *MongoStore) createIndexes(ctx context.Context) error {
+	indexes := make([]mongo.IndexModel, 0, len(uniqueIndexes))
+	for name, field := range uniqueIndexes {
+		if field == "_id" {
+			continue
+		}
+		indexes = append(indexes, mongo.IndexModel{
+			Keys: bson.D{{Key: field, Value: 1}, {Key: "deleted_at", Value: 1}},
+			Options: options.Index().SetName(name).SetUnique(true).
+				SetPartialFilterExpression(bson.D{{Key: field,
+					Value: bson.D{{Key: "$exists", Value: true}}}}),
+		})
+	}
+	indexes = append(indexes, mongo.IndexModel{
+		Keys:    bson.D{{Key: "deleted_at", Value: 1}},
+		Options: options.Index().SetName("deleted_at").SetSparse(true),
+	})
+	if _, err := ms.Collection.Indexes().CreateMany(ctx, indexes); err != nil {
+		return fmt.Errorf("failed to create unique indexes: %v", err)
+	}
+	return nil
+}
+
+// Create the index of the due entries and the TTL index of the delivered ones
+func (ms *MongoStore) createOutboxIndexes(ctx context.Context) error {
+	_, err := ms.Outbox.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "next_attempt_at", Value: 1}},
+			Options: options.Index().SetName("next_attempt_at").
+				SetSparse(true),
+		},
+		{
+			Keys: bson.D{{Key: "delivered_at", Value: 1}},
+			Options: options.Index().SetName("delivered_at_ttl").
+				SetExpireAfterSeconds(int32(consts.OUTBOX_DELIVERED_TTL.Seconds())),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create outbox indexes: %v", err)
+	}
+	return nil
+}
+
+/*
+Convert the driver error to the store error:
+the duplicate key to the ConflictError naming the field,
+the missing document to ErrNotFound, the wrong request to ErrInvalid
+and other errors, e.g. timeouts and network errors, to ErrUnavailable.
+*/
+func storeError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var storeErr *store_models.Error
+	var conflict *store_models.ConflictError
+	if errors.As(err, &storeErr) || errors.As(err, &conflict) {
+		return err
+	}
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		return store_models.NewError(store_models.ErrNotFound, err)
+	case mongo.IsDuplicateKeyError(err):
+		if field := duplicateField(err); field != "" {
+			return &store_models.ConflictError{Field: field}
+		}
+		return store_models.NewError(store_models.ErrConflict, err)
+	case isInvalid(err):
+		return store_models.NewError(store_models.ErrInvalid, err)
+	}
+	return store_models.NewError(store_models.ErrUnavailable, err)
 }
 
-// Performs a specific action on the database according to the received DoID
-func (ms *MongoStore) DoOne(act store_models.DoID, req store_models.IStoreDoRequest) (err error) {
+// Get the field of the unique index from the duplicate key error
+func duplicateField(err error) string {
+	match := dupKeyIndexRegexp.FindStringSubmatch(err.Error())
+	if match == nil {
+		return ""
+	}
+	return uniqueIndexes[match[1]]
+}
+
+// Check if the request can't be done by the store
+func isInvalid(err error) bool {
+	var marshalErr mongo.MarshalError
+	if errors.As(err, &marshalErr) || errors.Is(err, mongo.ErrNilDocument) {
+		return true
+	}
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) {
+		// BadValue, FailedToParse, TypeMismatch
+		return serverErr.HasErrorCode(2) || serverErr.HasErrorCode(9) ||
+			serverErr.HasErrorCode(14)
+	}
+	return false
+}
+
+// Limit the operation with the default timeout,
+// the deadline of the request is kept if it's earlier
+func withTimeout(ctx context.Context,
+	timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// Close the cursor on the server, also when the request is cancelled
+func closeCursor(cur *mongo.Cursor) {
+	ctx, cancel := context.WithTimeout(context.Background(),
+		consts.STORE_CURSOR_CLOSE_TIMEOUT)
+	defer cancel()
+	cur.Close(ctx)
+}
+
+/*
+Performs a specific action on the database according to the received DoID.
+Returns the document before the change, nil for ADD.
+If the outbox func is set, the change and the outbox message are written
+in one transaction, so the message exists only if the change is done.
+Transactions need the replica set.
+*/
+func (ms *MongoStore) DoOne(ctx context.Context, act store_models.DoID,
+	req store_models.IStoreDoRequest,
+	outbox store_models.OutboxFunc) (before store_models.IStoreGetResponse, err error) {
 
 	if req == nil {
-		return fmt.Errorf("the request couldn't be empty")
+		return nil, store_models.NewError(store_models.ErrInvalid,
+			fmt.Errorf("the request couldn't be empty"))
+	}
+	ctx, cancel := withTimeout(ctx, ms.WriteTimeout)
+	defer cancel()
+	if outbox == nil {
+		return ms.doOne(ctx, act, req)
+	}
+
+	session, err := ms.Client.StartSession()
+	if err != nil {
+		return nil, storeError(err)
+	}
+	defer session.EndSession(ctx)
+
+	// the func is repeated on the transient transaction errors
+	_, err = session.WithTransaction(ctx,
+		func(sc mongo.SessionContext) (interface{}, error) {
+			var err error
+			if before, err = ms.doOne(sc, act, req); err != nil {
+				return nil, err
+			}
+			message, err := outbox(before)
+			if err != nil {
+				return nil, err
+			}
+			return nil, ms.insertOutbox(sc, message)
+		})
+	if err != nil {
+		return nil, storeError(err)
 	}
+	return before, nil
+}
+
+func (ms *MongoStore) doOne(ctx context.Context, act store_models.DoID,
+	req store_models.IStoreDoRequest) (before store_models.IStoreGetResponse, err error) {
+
 	switch act {
 	case store_models.ADD:
-		err = ms.InsertOne(req)
+		err = ms.InsertOne(ctx, req)
 	case store_models.MODIFY:
-		err = ms.UpdateOne(req)
+		before, err = ms.UpdateOne(ctx, req)
 	case store_models.DELETE:
-		err = ms.DeleteOne(req)
+		before, err = ms.DeleteOne(ctx, req)
+	case store_models.UPDATE:
+		update, ok := req.(*store_models.UpdateRequest)
+		if !ok {
+			return nil, store_models.NewError(store_models.ErrInvalid,
+				fmt.Errorf("the update request is expected"))
+		}
+		before, err = ms.UpdateFields(ctx, update)
+	case store_models.RESTORE:
+		before, err = ms.RestoreOne(ctx, req)
 	default:
-		err = fmt.Errorf("wrong DoID type")
+		err = store_models.NewError(store_models.ErrInvalid,
+			fmt.Errorf("wrong DoID type"))
 	}
 	return
 }
 
-// Performs a specific getting on the database according to the received GetID
-func (ms *MongoStore) Get(act store_models.GetID,
-	filter interface{}) (results []store_models.IStoreGetResponse,
+// Write the message to the outbox, it's due at once
+func (ms *MongoStore) insertOutbox(ctx context.Context, message []byte) error {
+	now := time.Now().UTC()
+	_, err := ms.Outbox.InsertOne(ctx, outboxDoc{
+		ID:            string(util.GenID()),
+		Message:       string(message),
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	})
+	return storeError(err)
+}
+
+// Claim the oldest due entry of the outbox.
+// The entry is due again after the lease, so other relays
+// don't publish it at the same time and it isn't lost if the relay dies.
+func (ms *MongoStore) ClaimOutbox(ctx context.Context,
+	lease time.Duration) (*store_models.OutboxEntry, error) {
+
+	ctx, cancel := withTimeout(ctx, ms.WriteTimeout)
+	defer cancel()
+	now := time.Now().UTC()
+	res := ms.Outbox.FindOneAndUpdate(ctx,
+		bson.D{{Key: "next_attempt_at", Value: bson.D{{Key: "$lte", Value: now}}}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "next_attempt_at", Value: now.Add(lease)},
+		}}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "next_attempt_at", Value: 1}}))
+
+	doc := outboxDoc{}
+	if err := res.Decode(&doc); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, storeError(err)
+	}
+	return &store_models.OutboxEntry{
+		ID:       doc.ID,
+		Attempts: doc.Attempts,
+		Message:  []byte(doc.Message),
+	}, nil
+}
+
+// Mark the entry as delivered, it's removed by the TTL index later
+func (ms *MongoStore) MarkDelivered(ctx context.Context, id string) error {
+	ctx, cancel := withTimeout(ctx, ms.WriteTimeout)
+	defer cancel()
+	_, err := ms.Outbox.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}},
+		bson.D{
+			{Key: "$set", Value: bson.D{{Key: "delivered_at", Value: time.Now().UTC()}}},
+			{Key: "$unset", Value: bson.D{{Key: "next_attempt_at", Value: ""}}},
+		})
+	return storeError(err)
+}
+
+// Count the failed delivery and set the time of the next one
+func (ms *MongoStore) MarkFailed(ctx context.Context, id string, retryAt time.Time) error {
+	ctx, cancel := withTimeout(ctx, ms.WriteTimeout)
+	defer cancel()
+	_, err := ms.Outbox.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}},
+		bson.D{
+			{Key: "$set", Value: bson.D{{Key: "next_attempt_at", Value: retryAt.UTC()}}},
+			{Key: "$inc", Value: bson.D{{Key: "attempts", Value: 1}}},
+		})
+	return storeError(err)
+}
+
+// Mark the entry as dead, it isn't claimed anymore and kept for the inspection
+func (ms *MongoStore) MarkDead(ctx context.Context, id string, reason string) error {
+	ctx, cancel := withTimeout(ctx, ms.WriteTimeout)
+	defer cancel()
+	_, err := ms.Outbox.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}},
+		bson.D{
+			{Key: "$set", Value: bson.D{
+				{Key: "dead_at", Value: time.Now().UTC()},
+				{Key: "error", Value: reason},
+			}},
+			{Key: "$unset", Value: bson.D{{Key: "next_attempt_at", Value: ""}}},
+		})
+	return storeError(err)
+}
+
+// Performs a specific getting on the database according to the received GetID.
+// The query is limited by the read timeout.
+func (ms *MongoStore) Get(ctx context.Context, act store_models.GetID,
+	query *store_models.Query) (results []store_models.IStoreGetResponse,
 	err error) {
 
+	ctx, cancel := withTimeout(ctx, ms.ReadTimeout)
+	defer cancel()
+
+	var errs []error
+	switch act {
+	case store_models.GET_ALL:
+		results, errs = ms.GetAll(ctx, query)
+	case store_models.GET_FILTERED:
+		if query == nil || query.Filter == nil {
+			return nil, store_models.NewError(store_models.ErrInvalid,
+				fmt.Errorf("the filter couldn't be empty"))
+		}
+		results, errs = ms.GetFiltered(ctx, query)
+	default:
+		return nil, store_models.NewError(store_models.ErrInvalid,
+			fmt.Errorf("wrong GetID type"))
+	}
+	// join all errors to the one
+	err = util.JoinErrors(errs)
+	return
+}
+
+// Find the document by the id, the projection limits the returned fields
+func (ms *MongoStore) GetOne(ctx context.Context, id string,
+	projection interface{}) (store_models.IStoreGetResponse, error) {
+
+	ctx, cancel := withTimeout(ctx, ms.ReadTimeout)
+	defer cancel()
+
+	opts := options.FindOne()
+	if projection != nil {
+		opts.SetProjection(projection)
+	}
+	doc := make(store_models.IStoreGetResponse)
+	err := ms.Collection.FindOne(ctx, ms.idFilter(id), opts).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, store_models.NewError(store_models.ErrNotFound,
+			fmt.Errorf(consts.STORE_KEY_NOT_FOUND, id))
+	}
+	if err != nil {
+		return nil, storeError(err)
+	}
+	return doc, nil
+}
+
+// Performs a specific getting on the database according to the received GetID.
+// Documents are passed to the yield func in batches of batchSize
+// as soon as they are read from the cursor.
+// The stream isn't limited by the read timeout, it lasts until the ctx is done.
+func (ms *MongoStore) Stream(ctx context.Context, act store_models.GetID,
+	query *store_models.Query, batchSize int,
+	yield func([]store_models.IStoreGetResponse) error) (err error) {
+
 	var errs []error
 	switch act {
 	case store_models.GET_ALL:
-		results, errs = ms.GetAll()
+		errs = ms.StreamAll(ctx, query, batchSize, yield)
 	case store_models.GET_FILTERED:
-		if filter == nil {
-			return nil, fmt.Errorf("the filter couldn't be empty")
+		if query == nil || query.Filter == nil {
+			return store_models.NewError(store_models.ErrInvalid,
+				fmt.Errorf("the filter couldn't be empty"))
 		}
-		results, errs = ms.GetFiltered(filter)
+		errs = ms.StreamFiltered(ctx, query, batchSize, yield)
 	default:
-		return nil, fmt.Errorf("wrong DoID type")
+		return store_models.NewError(store_models.ErrInvalid,
+			fmt.Errorf("wrong GetID type"))
 	}
 	// join all errors to the one
 	err = util.JoinErrors(errs)
 	return
 }
 
+// Count the documents matched by the query, the limit of the query
+// stops the counting. The count is limited by the read timeout.
+func (ms *MongoStore) Count(ctx context.Context,
+	query *store_models.Query) (int64, error) {
+
+	ctx, cancel := withTimeout(ctx, ms.ReadTimeout)
+	defer cancel()
+
+	opts := options.Count()
+	if query.Limit > 0 {
+		opts.SetLimit(query.Limit)
+	}
+	if ms.ReadTimeout > 0 {
+		opts.SetMaxTime(ms.ReadTimeout)
+	}
+	n, err := ms.Collection.CountDocuments(ctx, ms.queryFilter(allQuery(query)), opts)
+	if err != nil {
+		return 0, storeError(err)
+	}
+	return n, nil
+}
+
 // Insert one document to the DB
-func (ms *MongoStore) InsertOne(req store_models.IStoreDoRequest) (err error) {
+func (ms *MongoStore) InsertOne(ctx context.Context,
+	req store_models.IStoreDoRequest) (err error) {
 
 	_, err = ms.Collection.InsertOne(ctx, req)
-	return
+	return storeError(err)
+}
+
+// Update one document in the DB, return the document before the update
+func (ms *MongoStore) UpdateOne(ctx context.Context,
+	req store_models.IStoreDoRequest) (store_models.IStoreGetResponse, error) {
+
+	filter := withVersion(ms.idFilter(req.GetID()), req)
+	update, err := modifyDoc(req)
+	if err != nil {
+		return nil, err
+	}
+
+	res := ms.Collection.FindOneAndUpdate(ctx, filter, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.Before))
+	return ms.decodeOne(ctx, res, req, ms.idFilter(req.GetID()))
+}
+
+// Set and remove the fields of one document, return the document before the update
+func (ms *MongoStore) UpdateFields(ctx context.Context,
+	req *store_models.UpdateRequest) (store_models.IStoreGetResponse, error) {
+
+	filter := withVersion(ms.idFilter(req.GetID()), req)
+	set, err := setDoc(req.Set)
+	if err != nil {
+		return nil, err
+	}
+	update := bson.D{
+		{Key: "$set", Value: set},
+		{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+	}
+	if len(req.Unset) != 0 {
+		unset := bson.D{}
+		for _, key := range req.Unset {
+			unset = append(unset, bson.E{Key: key, Value: ""})
+		}
+		update = append(update, bson.E{Key: "$unset", Value: unset})
+	}
+
+	res := ms.Collection.FindOneAndUpdate(ctx, filter, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.Before))
+	return ms.decodeOne(ctx, res, req, ms.idFilter(req.GetID()))
+}
+
+// Update of the modified document, the version is increased
+func modifyDoc(req store_models.IStoreDoRequest) (bson.D, error) {
+	set, err := setDoc(req)
+	if err != nil {
+		return nil, err
+	}
+	return bson.D{
+		{Key: "$set", Value: set},
+		{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+	}, nil
 }
 
-func (ms *MongoStore) UpdateOne(req store_models.IStoreDoRequest) (err error) {
-	filter := bson.D{{"_id", req.GetID()}}
-	// _, err = ms.collection.UpdateOne(ctx, filter, req)
+// Update of the soft deleted document
+func softDeleteDoc() bson.D {
+	return bson.D{
+		{Key: "$set", Value: softDeleteFields()},
+		{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+	}
+}
+
+// Fields set by the soft delete
+func softDeleteFields() bson.M {
+	now := time.Now().UTC()
+	return bson.M{"deleted_at": now, "updated_at": now}
+}
+
+// Convert the request to the document of the $set,
+// the version is increased by the update
+func setDoc(req store_models.IStoreDoRequest) (bson.M, error) {
 	pByte, err := bson.Marshal(req)
 	if err != nil {
-		return err
+		return nil, store_models.NewError(store_models.ErrInvalid, err)
 	}
 
 	var update bson.M
 	err = bson.Unmarshal(pByte, &update)
 	if err != nil {
-		return
+		return nil, store_models.NewError(store_models.ErrInvalid, err)
 	}
+	delete(update, "version")
+	return update, nil
+}
 
-	res, err := ms.Collection.UpdateOne(ctx, filter, bson.D{{Key: "$set", Value: update}})
+// Filter of the document by the id, the soft deleted document isn't found
+func (ms *MongoStore) idFilter(id interface{}) bson.D {
+	filter := bson.D{{Key: "_id", Value: id}}
+	if ms.SoftDelete {
+		filter = append(filter, notDeleted)
+	}
+	return filter
+}
 
-	if res.MatchedCount == 0 {
-		return fmt.Errorf(consts.STORE_KEY_NOT_FOUND, req.GetID())
+// Add the version to the filter of the changed document if it's expected
+func withVersion(filter bson.D, req store_models.IStoreDoRequest) bson.D {
+	if v, ok := req.(store_models.IVersionedRequest); ok && v.GetVersion() > 0 {
+		filter = append(filter, bson.E{Key: "version", Value: v.GetVersion()})
 	}
+	return filter
+}
+
+// Delete one document from the DB, return the deleted document.
+// The soft delete sets deleted_at and keeps the document until it's purged.
+func (ms *MongoStore) DeleteOne(ctx context.Context,
+	req store_models.IStoreDoRequest) (store_models.IStoreGetResponse, error) {
 
-	return err
+	found := ms.idFilter(req.GetID())
+	if !ms.SoftDelete {
+		res := ms.Collection.FindOneAndDelete(ctx, withVersion(found, req))
+		return ms.decodeOne(ctx, res, req, found)
+	}
+	res := ms.Collection.FindOneAndUpdate(ctx, withVersion(found, req),
+		softDeleteDoc(),
+		options.FindOneAndUpdate().SetReturnDocument(options.Before))
+	return ms.decodeOne(ctx, res, req, found)
 }
 
-func (ms *MongoStore) DeleteOne(req store_models.IStoreDoRequest) (err error) {
-	filter := bson.D{{"_id", req.GetID()}}
+// Restore the soft deleted document, return the document before the restore.
+// The fields of the request, e.g. updated_at, are set.
+func (ms *MongoStore) RestoreOne(ctx context.Context,
+	req store_models.IStoreDoRequest) (store_models.IStoreGetResponse, error) {
+
+	found := bson.D{
+		{Key: "_id", Value: req.GetID()},
+		{Key: "deleted_at", Value: bson.D{{Key: "$exists", Value: true}}},
+	}
+	set, err := setDoc(req)
+	if err != nil {
+		return nil, err
+	}
+	res := ms.Collection.FindOneAndUpdate(ctx, withVersion(found, req),
+		bson.D{
+			{Key: "$set", Value: set},
+			{Key: "$unset", Value: bson.D{{Key: "deleted_at", Value: ""}}},
+			{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.Before))
+	return ms.decodeOne(ctx, res, req, found)
+}
+
+// Hard-delete the documents soft deleted before the time
+func (ms *MongoStore) PurgeDeleted(ctx context.Context,
+	before time.Time) (int64, error) {
+
+	ctx, cancel := withTimeout(ctx, ms.WriteTimeout)
+	defer cancel()
+
+	res, err := ms.Collection.DeleteMany(ctx, bson.D{{Key: "deleted_at",
+		Value: bson.D{{Key: "$lt", Value: before.UTC()}}}})
+	if err != nil {
+		return 0, storeError(err)
+	}
+	return res.DeletedCount, nil
+}
 
-	res, err := ms.Collection.DeleteOne(ctx, filter)
+// Decode the result of the single document operation.
+// The missing document with the expected version is looked up
+// by the found filter to tell the version mismatch from the missing document.
+func (ms *MongoStore) decodeOne(ctx context.Context, res *mongo.SingleResult,
+	req store_models.IStoreDoRequest, found bson.D) (store_models.IStoreGetResponse, error) {
 
-	if res.DeletedCount == 0 {
-		return fmt.Errorf(consts.STORE_KEY_NOT_FOUND, req.GetID())
+	doc := make(store_models.IStoreGetResponse)
+	err := res.Decode(&doc)
+	if err == nil {
+		return doc, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, storeError(err)
+	}
+	if v, ok := req.(store_models.IVersionedRequest); ok && v.GetVersion() > 0 {
+		n, err := ms.Collection.CountDocuments(ctx, found, options.Count().SetLimit(1))
+		if err != nil {
+			return nil, storeError(err)
+		}
+		if n != 0 {
+			return nil, store_models.NewError(store_models.ErrVersionMismatch,
+				fmt.Errorf("the user %v doesn't have the version %d", req.GetID(), v.GetVersion()))
+		}
 	}
-	return err
+	return nil, store_models.NewError(store_models.ErrNotFound,
+		fmt.Errorf(consts.STORE_KEY_NOT_FOUND, req.GetID()))
 }
 
-func (ms *MongoStore) GetAll() (results []store_models.IStoreGetResponse,
-	errs []error) {
+func (ms *MongoStore) GetAll(ctx context.Context,
+	query *store_models.Query) (results []store_models.IStoreGetResponse, errs []error) {
 
 	// send empty filter
-	return ms.GetFiltered(bson.D{{}})
+	return ms.GetFiltered(ctx, allQuery(query))
 }
 
-func (ms *MongoStore) GetFiltered(filter interface{}) (results []store_models.IStoreGetResponse,
-	errs []error) {
+func (ms *MongoStore) GetFiltered(ctx context.Context,
+	query *store_models.Query) (results []store_models.IStoreGetResponse, errs []error) {
 
 	// d.Shared.BsonToJSONPrint(filter)
 
-	cur, err := ms.Collection.Find(ctx, filter)
+	opts := findOptions(query)
+	// the server stops the query too
+	if ms.ReadTimeout > 0 {
+		opts.SetMaxTime(ms.ReadTimeout)
+	}
+	cur, err := ms.Collection.Find(ctx, ms.queryFilter(query), opts)
 	if err != nil {
-		errs = append(errs, err)
+		errs = append(errs, storeError(err))
 		return
 	}
-	defer cur.Close(ctx)
+	defer closeCursor(cur)
 
 	// Loop through the cursor
 	for cur.Next(ctx) {
 		res := make(store_models.IStoreGetResponse, 0)
 		err := cur.Decode(res)
 		if err != nil {
-			errs = append(errs, err)
+			errs = append(errs, storeError(err))
 		} else {
 			results = append(results, res)
 		}
 	}
 	if err := cur.Err(); err != nil {
-		errs = append(errs, err)
+		errs = append(errs, storeError(err))
+	}
+
+	return
+}
+
+func (ms *MongoStore) StreamAll(ctx context.Context, query *store_models.Query,
+	batchSize int, yield func([]store_models.IStoreGetResponse) error) (errs []error) {
+
+	// send empty filter
+	return ms.StreamFiltered(ctx, allQuery(query), batchSize, yield)
+}
+
+// The cursor is closed on the server when the ctx is cancelled
+func (ms *MongoStore) StreamFiltered(ctx context.Context, query *store_models.Query,
+	batchSize int, yield func([]store_models.IStoreGetResponse) error) (errs []error) {
+
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	opts := findOptions(query).SetBatchSize(int32(batchSize))
+
+	cur, err := ms.Collection.Find(ctx, ms.queryFilter(query), opts)
+	if err != nil {
+		errs = append(errs, storeError(err))
+		return
+	}
+	defer closeCursor(cur)
+
+	// Loop through the cursor and yield the full batches
+	batch := make([]store_models.IStoreGetResponse, 0, batchSize)
+	for cur.Next(ctx) {
+		res := make(store_models.IStoreGetResponse, 0)
+		if err := cur.Decode(res); err != nil {
+			errs = append(errs, storeError(err))
+			continue
+		}
+		batch = append(batch, res)
+		if len(batch) < batchSize {
+			continue
+		}
+		if err := yield(batch); err != nil {
+			errs = append(errs, err)
+			return
+		}
+		batch = make([]store_models.IStoreGetResponse, 0, batchSize)
+	}
+	if err := cur.Err(); err != nil {
+		errs = append(errs, storeError(err))
+	}
+	// yield the rest
+	if len(batch) > 0 {
+		if err := yield(batch); err != nil {
+			errs = append(errs, err)
+		}
 	}
 
 	return
 }
+
+// Return the query for all documents, keeping the paging of the received one
+func allQuery(query *store_models.Query) *store_models.Query {
+	q := &store_models.Query{}
+	if query != nil {
+		*q = *query
+	}
+	if q.Filter == nil {
+		q.Filter = bson.D{}
+	}
+	return q
+}
+
+// Filter of the query, the soft deleted documents are excluded
+// if the query doesn't include them
+func (ms *MongoStore) queryFilter(query *store_models.Query) interface{} {
+	if !ms.SoftDelete || query.IncludeDeleted {
+		return query.Filter
+	}
+	return bson.D{{Key: "$and", Value: bson.A{query.Filter, bson.D{notDeleted}}}}
+}
+
+// Convert the query settings to the find options
+func findOptions(query *store_models.Query) *options.FindOptions {
+	opts := options.Find()
+	if query.Limit > 0 {
+		opts.SetLimit(query.Limit)
+	}
+	if query.Sort != nil {
+		opts.SetSort(query.Sort)
+	}
+	return opts
+}
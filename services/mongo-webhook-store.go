@@ -0,0 +1,57 @@
+package services
+
+import (
+	webhook_models "api/models/webhook"
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Save the registered webhook
+func (ms *MongoStore) AddWebhook(ctx context.Context, webhook *webhook_models.Webhook) error {
+	ctx, cancel := withTimeout(ctx, ms.WriteTimeout)
+	defer cancel()
+	_, err := ms.Webhooks.InsertOne(ctx, webhook)
+	return storeError(err)
+}
+
+// Return all registered webhooks in the order of the registration
+func (ms *MongoStore) ListWebhooks(ctx context.Context) ([]*webhook_models.Webhook, error) {
+	ctx, cancel := withTimeout(ctx, ms.ReadTimeout)
+	defer cancel()
+	cur, err := ms.Webhooks.Find(ctx, bson.D{},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return nil, storeError(err)
+	}
+	webhooks := []*webhook_models.Webhook{}
+	if err := cur.All(ctx, &webhooks); err != nil {
+		return nil, storeError(err)
+	}
+	return webhooks, nil
+}
+
+// Delete the registered webhook
+func (ms *MongoStore) DeleteWebhook(ctx context.Context, id string) error {
+	ctx, cancel := withTimeout(ctx, ms.WriteTimeout)
+	defer cancel()
+	res, err := ms.Webhooks.DeleteOne(ctx, bson.D{{Key: "_id", Value: id}})
+	if err != nil {
+		return storeError(err)
+	}
+	if res.DeletedCount == 0 {
+		return webhook_models.ErrWebhookNotFound
+	}
+	return nil
+}
+
+// Save the failed delivery
+func (ms *MongoStore) AddDeadLetter(ctx context.Context, letter *webhook_models.DeadLetter) error {
+	ctx, cancel := withTimeout(ctx, ms.WriteTimeout)
+	defer cancel()
+	// the delivery which is dead again replaces the old letter
+	_, err := ms.DeadLetters.ReplaceOne(ctx, bson.D{{Key: "_id", Value: letter.ID}},
+		letter, options.Replace().SetUpsert(true))
+	return storeError(err)
+}
@@ -0,0 +1,128 @@
+package services
+
+import (
+	"api/consts"
+	watcher_models "api/models/watcher"
+	"api/util"
+	"context"
+	"sync"
+)
+
+/*
+MultiPublisher publishes the events through all publishers.
+Every publisher acks the event on its own: the failed event is published
+again only through the publishers which didn't publish it.
+The acks are kept in the memory, so after the restart the event
+is published again through all publishers.
+*/
+type MultiPublisher struct {
+	Publishers []watcher_models.IPublisher
+	// max number of the failed events with the acks,
+	// the acks of the oldest ones are forgotten
+	MaxFailed int
+
+	mu sync.Mutex
+	// publishers which published the failed events by the event ID
+	acked map[string][]bool
+	// IDs of the failed events from the oldest one
+	order []string
+}
+
+// Init new MultiPublisher, WATCHER_MAX_FAILED_EVENTS is used by default
+func NewMultiPublisher(publishers ...watcher_models.IPublisher) *MultiPublisher {
+	return &MultiPublisher{
+		Publishers: publishers,
+		MaxFailed:  consts.WATCHER_MAX_FAILED_EVENTS,
+		acked:      make(map[string][]bool),
+	}
+}
+
+// Publish the event at once through every publisher which didn't publish it yet,
+// so the slow one doesn't take the time of the others. The errors are joined.
+func (p *MultiPublisher) Publish(ctx context.Context,
+	event *watcher_models.ChangeEvent) error {
+
+	acked := p.ackedBy(event.ID)
+	results := make([]error, len(p.Publishers))
+	var wg sync.WaitGroup
+	for i, publisher := range p.Publishers {
+		if acked[i] {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, publisher watcher_models.IPublisher) {
+			defer wg.Done()
+			results[i] = publisher.Publish(ctx, event)
+		}(i, publisher)
+	}
+	wg.Wait()
+
+	var errs []error
+	for i, err := range results {
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		acked[i] = true
+	}
+	p.ack(event.ID, acked, len(errs) != 0)
+	return util.JoinErrors(errs)
+}
+
+// Close all publishers
+func (p *MultiPublisher) Close() {
+	for _, publisher := range p.Publishers {
+		publisher.Close()
+	}
+}
+
+// Return the copy of the acks of the event
+func (p *MultiPublisher) ackedBy(id string) []bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	acked := make([]bool, len(p.Publishers))
+	copy(acked, p.acked[id])
+	return acked
+}
+
+// Keep the acks of the failed event, forget the acks of the published one
+func (p *MultiPublisher) ack(id string, acked []bool, failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !failed {
+		delete(p.acked, id)
+		return
+	}
+	if _, ok := p.acked[id]; !ok {
+		p.order = append(p.order, id)
+	}
+	p.acked[id] = acked
+	for len(p.acked) > p.maxFailed() && len(p.order) > 0 {
+		delete(p.acked, p.order[0])
+		p.order = p.order[1:]
+	}
+	// remove the IDs of the published events
+	if len(p.order) > 2*p.maxFailed() {
+		// the last ID of the repeated event is kept
+		last := make(map[string]int, len(p.acked))
+		for i, id := range p.order {
+			last[id] = i
+		}
+		order := make([]string, 0, len(p.acked))
+		for i, id := range p.order {
+			if _, ok := p.acked[id]; ok && last[id] == i {
+				order = append(order, id)
+			}
+		}
+		p.order = order
+	}
+}
+
+func (p *MultiPublisher) maxFailed() int {
+	if p.MaxFailed <= 0 {
+		return consts.WATCHER_MAX_FAILED_EVENTS
+	}
+	return p.MaxFailed
+}
@@ -0,0 +1,93 @@
+package services
+
+import (
+	watcher_models "api/models/watcher"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Replace the characters which can't be used in the subject token
+var subjectReplacer = strings.NewReplacer(".", "_", "*", "_", ">", "_",
+	" ", "_", "\t", "_", "\r", "_", "\n", "_")
+
+type NatsPublisher struct {
+	URL    string
+	Stream string
+	// prefix of the subjects, the user ID is the last token
+	Subject string
+	// nats connection
+	Conn *nats.Conn
+	// jet stream context
+	js nats.JetStreamContext
+}
+
+/*
+Init new NatsPublisher.
+The stream is created for the subjects with the prefix if it doesn't exist.
+The opts are passed to the connection, e.g. the credentials.
+*/
+func NewNatsPublisher(url string, stream string, subject string,
+	opts ...nats.Option) (*NatsPublisher, error) {
+
+	if stream == "" || subject == "" {
+		return nil, fmt.Errorf("nats: the stream and the subject must be set")
+	}
+	conn, err := nats.Connect(url, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("nats: Connect error: %v", err)
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("nats: JetStream error: %v", err)
+	}
+
+	// check the stream
+	_, err = js.StreamInfo(stream)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:     stream,
+			Subjects: []string{subject + ".>"},
+		})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("nats: stream %s check error: %v", stream, err)
+	}
+	return &NatsPublisher{
+		URL:     url,
+		Stream:  stream,
+		Subject: subject,
+		Conn:    conn,
+		js:      js,
+	}, nil
+}
+
+// Close the connection, pending messages are flushed
+func (p *NatsPublisher) Close() {
+	p.Conn.Drain()
+}
+
+// Send the event to the stream and wait for the acknowledgement.
+// The subject is the prefix with the user ID, so the events of the user
+// can be consumed in order by the subject filter.
+// The headers are the same as the pub-sub attributes.
+func (p *NatsPublisher) Publish(ctx context.Context,
+	event *watcher_models.ChangeEvent) error {
+
+	data, err := event.Marshal()
+	if err != nil {
+		return err
+	}
+	msg := nats.NewMsg(p.Subject + "." + subjectReplacer.Replace(event.UserID))
+	msg.Data = data
+	for key, value := range eventAttributes(event) {
+		msg.Header.Set(key, value)
+	}
+	_, err = p.js.PublishMsg(msg, nats.Context(ctx))
+	return err
+}
@@ -0,0 +1,171 @@
+package services
+
+import (
+	watcher_models "api/models/watcher"
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+// Run the in-process server with JetStream
+func runJetStream(t *testing.T) *server.Server {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+	srv := natsserver.RunServer(&opts)
+	t.Cleanup(srv.Shutdown)
+	return srv
+}
+
+func TestNatsPublisherPublish(t *testing.T) {
+	srv := runJetStream(t)
+	p, err := NewNatsPublisher(srv.ClientURL(), "USERS", "users.events")
+	if err != nil {
+		t.Fatalf("NewNatsPublisher error: %v", err)
+	}
+	defer p.Close()
+
+	added := userEvent(watcher_models.USER_ADDED, "user-1", 0)
+	added.RequestID = "request-1"
+	sent := []*watcher_models.ChangeEvent{
+		added,
+		userEvent(watcher_models.USER_ADDED, "user-2", 1),
+		userEvent(watcher_models.USER_DELETED, "user-1", 2),
+	}
+	for _, event := range sent {
+		if err := p.Publish(context.Background(), event); err != nil {
+			t.Fatalf("Publish error: %v", err)
+		}
+	}
+
+	// the events of one user are consumed in order by the subject filter
+	sub, err := p.js.SubscribeSync("users.events.user-1", nats.DeliverAll())
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+	for _, want := range []*watcher_models.ChangeEvent{sent[0], sent[2]} {
+		msg, err := sub.NextMsg(5 * time.Second)
+		if err != nil {
+			t.Fatalf("failed to get the message: %v", err)
+		}
+		var got watcher_models.ChangeEvent
+		if err := json.Unmarshal(msg.Data, &got); err != nil {
+			t.Fatalf("the message isn't the JSON event: %v", err)
+		}
+		if !reflect.DeepEqual(&got, want) {
+			t.Errorf("event = %+v, want %+v", got, want)
+		}
+		for key, value := range eventAttributes(want) {
+			if got := msg.Header.Get(key); got != value {
+				t.Errorf("header %s = %q, want %q", key, got, value)
+			}
+		}
+	}
+	if msg, err := sub.NextMsg(100 * time.Millisecond); err == nil {
+		t.Errorf("got the message of %s, want only user-1", msg.Subject)
+	}
+}
+
+func TestNatsPublisherSubject(t *testing.T) {
+	srv := runJetStream(t)
+	p, err := NewNatsPublisher(srv.ClientURL(), "USERS", "users.events")
+	if err != nil {
+		t.Fatalf("NewNatsPublisher error: %v", err)
+	}
+	defer p.Close()
+
+	// the user ID is one token of the subject without the wildcards
+	tests := []struct {
+		userID  string
+		subject string
+	}{
+		{userID: "53a14348-0cdc-485c-92c8-458018fe147c",
+			subject: "users.events.53a14348-0cdc-485c-92c8-458018fe147c"},
+		{userID: "user.id", subject: "users.events.user_id"},
+		{userID: "user*>", subject: "users.events.user__"},
+		{userID: "user\tid 1", subject: "users.events.user_id_1"},
+	}
+	for _, tt := range tests {
+		event := userEvent(watcher_models.USER_ADDED, tt.userID, 0)
+		if err := p.Publish(context.Background(), event); err != nil {
+			t.Fatalf("Publish %q error: %v", tt.userID, err)
+		}
+		msg, err := p.js.GetLastMsg("USERS", tt.subject)
+		if err != nil {
+			t.Errorf("failed to get the message of %s: %v", tt.subject, err)
+			continue
+		}
+		// the header keeps the original ID
+		if got := msg.Header.Get("user_id"); got != tt.userID {
+			t.Errorf("user_id header = %q, want %q", got, tt.userID)
+		}
+	}
+}
+
+func TestNewNatsPublisherStream(t *testing.T) {
+	srv := runJetStream(t)
+	conn, err := nats.Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	js, err := conn.JetStream()
+	if err != nil {
+		t.Fatalf("JetStream error: %v", err)
+	}
+	// the existing stream is kept with its config
+	_, err = js.AddStream(&nats.StreamConfig{Name: "AUDIT",
+		Subjects: []string{"audit.>"}, MaxMsgs: 10})
+	if err != nil {
+		t.Fatalf("failed to add the stream: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		stream   string
+		subject  string
+		subjects []string
+		wantErr  bool
+	}{
+		{name: "missing stream", stream: "USERS", subject: "users.events",
+			subjects: []string{"users.events.>"}},
+		{name: "existing stream", stream: "AUDIT", subject: "audit",
+			subjects: []string{"audit.>"}},
+		{name: "empty stream", subject: "users.events", wantErr: true},
+		{name: "empty subject", stream: "USERS", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewNatsPublisher(srv.ClientURL(), tt.stream, tt.subject)
+			if tt.wantErr {
+				if err == nil {
+					p.Close()
+					t.Fatal("NewNatsPublisher error = nil, want the error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewNatsPublisher error: %v", err)
+			}
+			defer p.Close()
+			info, err := js.StreamInfo(tt.stream)
+			if err != nil {
+				t.Fatalf("StreamInfo error: %v", err)
+			}
+			if !reflect.DeepEqual(info.Config.Subjects, tt.subjects) {
+				t.Errorf("subjects = %v, want %v", info.Config.Subjects, tt.subjects)
+			}
+		})
+	}
+	if info, err := js.StreamInfo("AUDIT"); err != nil || info.Config.MaxMsgs != 10 {
+		t.Errorf("the existing stream is changed: %+v, %v", info, err)
+	}
+}
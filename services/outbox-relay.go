@@ -0,0 +1,154 @@
+package services
+
+import (
+	"api/consts"
+	store_models "api/models/store"
+	watcher_models "api/models/watcher"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// OutboxRelay publishes the outbox entries through the watcher
+type OutboxRelay struct {
+	Outbox  store_models.IOutbox
+	Watcher watcher_models.IWatcher
+	// how often the outbox is checked
+	Interval time.Duration
+	// the entry is dead after MaxAttempts failures
+	MaxAttempts int
+	// closed by Stop
+	stop chan struct{}
+	// closed when Start returns
+	done chan struct{}
+}
+
+// Init new OutboxRelay, OUTBOX_POLL_INTERVAL and OUTBOX_MAX_ATTEMPTS are used by default
+func NewOutboxRelay(outbox store_models.IOutbox, watcher watcher_models.IWatcher,
+	interval time.Duration, maxAttempts int) *OutboxRelay {
+
+	if interval <= 0 {
+		interval = consts.OUTBOX_POLL_INTERVAL
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = consts.OUTBOX_MAX_ATTEMPTS
+	}
+	return &OutboxRelay{
+		Outbox:      outbox,
+		Watcher:     watcher,
+		Interval:    interval,
+		MaxAttempts: maxAttempts,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// Start relay the entries.
+// The func should run like a goroutine.
+func (r *OutboxRelay) Start() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		r.relay()
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop the relay, the entry in progress is finished first.
+// Entries left in the outbox are published after the restart.
+func (r *OutboxRelay) Stop() {
+	close(r.stop)
+	select {
+	case <-r.done:
+	case <-time.After(consts.WATCHER_CLOSE_TIMEOUT):
+		log.Printf("OutboxRelay: stop timeout")
+	}
+}
+
+/*
+Publish all due entries.
+The delivery is at least once: the entry is marked as delivered only
+after the watcher confirms it. The failed entry is retried with
+the exponential backoff and doesn't block the next entries.
+The entry is dead after MaxAttempts failures, the message
+which isn't the event is dead at once.
+*/
+func (r *OutboxRelay) relay() {
+	ctx := context.Background()
+	for {
+		select {
+		case <-r.stop:
+			return
+		default:
+		}
+		entry, err := r.Outbox.ClaimOutbox(ctx, consts.OUTBOX_LEASE)
+		if err != nil {
+			log.Printf("OutboxRelay: failed to claim the entry: %v", err)
+			return
+		}
+		if entry == nil {
+			return
+		}
+		event := &watcher_models.ChangeEvent{}
+		if err := json.Unmarshal(entry.Message, event); err != nil {
+			// the retry can't decode it either
+			r.dead(ctx, entry, fmt.Errorf("failed to decode the event: %v", err))
+			continue
+		}
+		if err := r.publish(event); err != nil {
+			if entry.Attempts+1 >= r.MaxAttempts {
+				r.dead(ctx, entry, err)
+				continue
+			}
+			retryAt := time.Now().Add(backoff(entry.Attempts,
+				consts.WATCHER_RETRY_MIN_DELAY, consts.WATCHER_RETRY_MAX_DELAY))
+			log.Printf("OutboxRelay: failed to publish the entry %s (attempt %d), retry at %s: %v",
+				entry.ID, entry.Attempts+1, retryAt.UTC().Format(consts.TIME_FORMAT), err)
+			if err := r.Outbox.MarkFailed(ctx, entry.ID, retryAt); err != nil {
+				log.Printf("OutboxRelay: failed to mark the entry %s: %v", entry.ID, err)
+			}
+			continue
+		}
+		if err := r.Outbox.MarkDelivered(ctx, entry.ID); err != nil {
+			// the entry is published again after the lease
+			log.Printf("OutboxRelay: failed to mark the entry %s: %v", entry.ID, err)
+		}
+	}
+}
+
+// Publish the event through the watcher
+func (r *OutboxRelay) publish(event *watcher_models.ChangeEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(),
+		consts.WATCHER_PUBLISH_TIMEOUT)
+	defer cancel()
+	return r.Watcher.Publish(ctx, event)
+}
+
+// Stop the delivery of the entry
+func (r *OutboxRelay) dead(ctx context.Context, entry *store_models.OutboxEntry, err error) {
+	log.Printf("OutboxRelay: the entry %s is dead after %d attempts: %v",
+		entry.ID, entry.Attempts+1, err)
+	if err := r.Outbox.MarkDead(ctx, entry.ID, err.Error()); err != nil {
+		log.Printf("OutboxRelay: failed to mark the entry %s: %v", entry.ID, err)
+	}
+}
+
+// Delay before the next attempt, doubled after each failure from min up to max
+func backoff(attempts int, min time.Duration, max time.Duration) time.Duration {
+	delay := min
+	for i := 0; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
@@ -0,0 +1,138 @@
+package services
+
+import (
+	store_models "api/models/store"
+	watcher_models "api/models/watcher"
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Outbox entry with its state
+type memoryEntry struct {
+	entry     store_models.OutboxEntry
+	due       time.Time
+	delivered bool
+	dead      string
+}
+
+// Outbox in the memory
+type memoryOutbox struct {
+	mu      sync.Mutex
+	entries []*memoryEntry
+}
+
+func (o *memoryOutbox) add(id string, attempts int, message []byte) {
+	o.entries = append(o.entries, &memoryEntry{entry: store_models.OutboxEntry{
+		ID: id, Attempts: attempts, Message: message}})
+}
+
+func (o *memoryOutbox) find(id string) *memoryEntry {
+	for _, e := range o.entries {
+		if e.entry.ID == id {
+			return e
+		}
+	}
+	return nil
+}
+
+func (o *memoryOutbox) ClaimOutbox(ctx context.Context,
+	lease time.Duration) (*store_models.OutboxEntry, error) {
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := time.Now()
+	for _, e := range o.entries {
+		if !e.delivered && e.dead == "" && !e.due.After(now) {
+			e.due = now.Add(lease)
+			entry := e.entry
+			return &entry, nil
+		}
+	}
+	return nil, nil
+}
+
+func (o *memoryOutbox) MarkDelivered(ctx context.Context, id string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.find(id).delivered = true
+	return nil
+}
+
+func (o *memoryOutbox) MarkFailed(ctx context.Context, id string, retryAt time.Time) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	e := o.find(id)
+	e.entry.Attempts++
+	e.due = retryAt
+	return nil
+}
+
+func (o *memoryOutbox) MarkDead(ctx context.Context, id string, reason string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.find(id).dead = reason
+	return nil
+}
+
+// Watcher publishing to the recording publisher
+type publisherWatcher struct {
+	publisher *recordingPublisher
+}
+
+func (w *publisherWatcher) Listen()                              {}
+func (w *publisherWatcher) Close()                               {}
+func (w *publisherWatcher) GetQueue() watcher_models.IEventQueue { return nil }
+
+func (w *publisherWatcher) Publish(ctx context.Context,
+	event *watcher_models.ChangeEvent) error {
+
+	return w.publisher.Publish(ctx, event)
+}
+
+func TestOutboxRelay(t *testing.T) {
+	message := func(userID string) []byte {
+		data, err := userEvent(watcher_models.USER_ADDED, userID, 0).Marshal()
+		if err != nil {
+			t.Fatalf("Marshal error: %v", err)
+		}
+		return data
+	}
+	outbox := &memoryOutbox{}
+	outbox.add("delivered", 0, message("user-1"))
+	outbox.add("not json", 0, []byte("{user-1"))
+	outbox.add("failed", 0, message("user-2"))
+	outbox.add("last attempt", 2, message("user-2"))
+	outbox.add("after the dead", 0, message("user-3"))
+
+	publisher := &recordingPublisher{failed: map[string]bool{"user-2": true}}
+	r := NewOutboxRelay(outbox, &publisherWatcher{publisher: publisher}, time.Hour, 3)
+	r.relay()
+
+	tests := []struct {
+		id        string
+		delivered bool
+		dead      bool
+		attempts  int
+	}{
+		{id: "delivered", delivered: true},
+		// the decode error isn't retried
+		{id: "not json", dead: true},
+		{id: "failed", attempts: 1},
+		{id: "last attempt", dead: true, attempts: 2},
+		{id: "after the dead", delivered: true},
+	}
+	for _, tt := range tests {
+		e := outbox.find(tt.id)
+		if e.delivered != tt.delivered || (e.dead != "") != tt.dead ||
+			e.entry.Attempts != tt.attempts {
+			t.Errorf("entry %q: delivered %t, dead %q, attempts %d, want %t, %t, %d",
+				tt.id, e.delivered, e.dead, e.entry.Attempts,
+				tt.delivered, tt.dead, tt.attempts)
+		}
+	}
+	if len(publisher.events) != 2 {
+		t.Errorf("published %d events, want 2", len(publisher.events))
+	}
+}
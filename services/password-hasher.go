@@ -0,0 +1,125 @@
+package services
+
+import (
+	"api/consts"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher hashes passwords with the configured algorithm.
+// Hashes of both algorithms are verified, so the algorithm can be changed
+// without breaking the stored passwords.
+type PasswordHasher struct {
+	Algorithm string
+}
+
+// Init new PasswordHasher, the empty algorithm means bcrypt
+func NewPasswordHasher(algorithm string) (*PasswordHasher, error) {
+	switch algorithm {
+	case "":
+		algorithm = consts.PASSWORD_HASH_ALGORITHM
+	case consts.PASSWORD_HASH_BCRYPT, consts.PASSWORD_HASH_ARGON2ID:
+	default:
+		return nil, fmt.Errorf("unknown password hash algorithm: %s", algorithm)
+	}
+	return &PasswordHasher{
+		Algorithm: algorithm,
+	}, nil
+}
+
+// Hash the password
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	if h.Algorithm == consts.PASSWORD_HASH_ARGON2ID {
+		return argon2idHash(password)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), consts.PASSWORD_BCRYPT_COST)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Compare the password with the hash
+func (h *PasswordHasher) Verify(hash string, password string) (bool, error) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return argon2idVerify(hash, password)
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Hash the password with argon2id to the PHC string format:
+// $argon2id$v=19$m=65536,t=1,p=4$<salt>$<hash>
+func argon2idHash(password string) (string, error) {
+	salt := make([]byte, consts.PASSWORD_ARGON2_SALT)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt,
+		consts.PASSWORD_ARGON2_TIME, consts.PASSWORD_ARGON2_MEMORY,
+		consts.PASSWORD_ARGON2_THREADS, consts.PASSWORD_ARGON2_KEY_LEN)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, consts.PASSWORD_ARGON2_MEMORY,
+		consts.PASSWORD_ARGON2_TIME, consts.PASSWORD_ARGON2_THREADS,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Compare the password with the argon2id hash,
+// the parameters are taken from the hash
+func argon2idVerify(hash string, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, fmt.Errorf("invalid argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, fmt.Errorf("invalid argon2id hash: %v", err)
+	}
+	if version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2id version: %d", version)
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d",
+		&memory, &time, &threads); err != nil {
+		return false, fmt.Errorf("invalid argon2id hash: %v", err)
+	}
+	// the parameters come from the store, the zero ones panic
+	// and the huge ones exhaust the memory or the CPU
+	if time < 1 || time > consts.PASSWORD_ARGON2_MAX_TIME ||
+		memory < consts.PASSWORD_ARGON2_MIN_MEMORY || memory > consts.PASSWORD_ARGON2_MAX_MEMORY ||
+		threads < 1 || threads > consts.PASSWORD_ARGON2_MAX_THREADS {
+		return false, fmt.Errorf("invalid argon2id hash: parameters out of range: m=%d,t=%d,p=%d",
+			memory, time, threads)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("invalid argon2id hash: %v", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, fmt.Errorf("invalid argon2id hash: %v", err)
+	}
+	if len(salt) < consts.PASSWORD_ARGON2_MIN_SALT || len(salt) > consts.PASSWORD_ARGON2_MAX_SALT ||
+		len(key) < consts.PASSWORD_ARGON2_MIN_KEY_LEN || len(key) > consts.PASSWORD_ARGON2_MAX_KEY_LEN {
+		return false, fmt.Errorf("invalid argon2id hash: salt or key length out of range")
+	}
+
+	otherKey := argon2.IDKey([]byte(password), salt,
+		time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, otherKey) == 1, nil
+}
@@ -0,0 +1,127 @@
+package services
+
+import (
+	watcher_models "api/models/watcher"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/option"
+)
+
+type PubSubPublisher struct {
+	ProjectID string
+	Topic     string
+	// pub-sub client
+	Client *pubsub.Client
+	// pub-sub topic
+	topic *pubsub.Topic
+}
+
+/*
+Init new PubSubPublisher.
+The empty project means the publisher only prints messages to the log.
+The credsPath is the path to the service account key file,
+the empty path uses the default credentials.
+If PUBSUB_EMULATOR_HOST is set, the client connects to the emulator
+and the topic is created if needed.
+The opts are passed to the client, e.g. the connection to the pstest server.
+*/
+func NewPubSubPublisher(project string, topic string, credsPath string,
+	opts ...option.ClientOption) (*PubSubPublisher, error) {
+
+	p := &PubSubPublisher{
+		ProjectID: project,
+		Topic:     topic,
+	}
+	if project == "" {
+		log.Printf("PubSubPublisher: the project is not set, messages are only logged")
+		return p, nil
+	}
+	if topic == "" {
+		return nil, fmt.Errorf("pubsub: the topic is not set")
+	}
+
+	emulator := os.Getenv("PUBSUB_EMULATOR_HOST")
+	if credsPath != "" && emulator == "" {
+		opts = append(opts, option.WithCredentialsFile(credsPath))
+	}
+
+	ctx := context.Background()
+	client, err := pubsub.NewClient(ctx, project, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("pubsub: NewClient error: %v", err)
+	}
+	p.Client = client
+
+	// check the topic
+	p.topic = client.Topic(topic)
+	exists, err := p.topic.Exists(ctx)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("pubsub: topic %s check error: %v", topic, err)
+	}
+	if !exists {
+		if emulator == "" {
+			client.Close()
+			return nil, fmt.Errorf("pubsub: topic %s doesn't exist", topic)
+		}
+		if p.topic, err = client.CreateTopic(ctx, topic); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("pubsub: CreateTopic error: %v", err)
+		}
+	}
+	// events of the same user are published in order
+	p.topic.EnableMessageOrdering = true
+	return p, nil
+}
+
+// Close the Client
+func (p *PubSubPublisher) Close() {
+	if p.Client == nil {
+		return
+	}
+	p.topic.Stop()
+	p.Client.Close()
+}
+
+// Send the event to the pub-sub topic and wait for the server to confirm.
+// The message data is the JSON event, the attributes help to filter messages
+// without decoding the data. The user ID is the ordering key.
+func (p *PubSubPublisher) Publish(ctx context.Context,
+	event *watcher_models.ChangeEvent) error {
+
+	data, err := event.Marshal()
+	if err != nil {
+		return err
+	}
+	if p.Client == nil {
+		log.Printf("PubSubPublisher: Received the PUB SUB Message: %s", data)
+		return nil
+	}
+	res := p.topic.Publish(ctx, &pubsub.Message{
+		Data:        data,
+		Attributes:  eventAttributes(event),
+		OrderingKey: event.UserID,
+	})
+	// wait for the server to confirm
+	if _, err = res.Get(ctx); err != nil {
+		// publishing of the key is paused after the error
+		p.topic.ResumePublish(event.UserID)
+		return err
+	}
+	return nil
+}
+
+// Attributes of the event message
+func eventAttributes(event *watcher_models.ChangeEvent) map[string]string {
+	return map[string]string{
+		"schema_version": strconv.Itoa(event.SchemaVersion),
+		"type":           string(event.Type),
+		"user_id":        event.UserID,
+		"request_id":     event.RequestID,
+	}
+}
@@ -0,0 +1,179 @@
+package services
+
+import (
+	watcher_models "api/models/watcher"
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Start the pstest server
+func runPstest(t *testing.T) *pstest.Server {
+	srv := pstest.NewServer()
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+// Connect to the pstest server, the client closes the connection
+func pstestConn(t *testing.T, srv *pstest.Server) option.ClientOption {
+	conn, err := grpc.Dial(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to dial the server: %v", err)
+	}
+	return option.WithGRPCConn(conn)
+}
+
+// Create the topic on the pstest server
+func createTopic(t *testing.T, srv *pstest.Server, topic string) {
+	ctx := context.Background()
+	client, err := pubsub.NewClient(ctx, "project", pstestConn(t, srv))
+	if err != nil {
+		t.Fatalf("failed to create the client: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.CreateTopic(ctx, topic); err != nil {
+		t.Fatalf("failed to create the topic: %v", err)
+	}
+}
+
+func TestPubSubPublisherPublish(t *testing.T) {
+	srv := runPstest(t)
+	createTopic(t, srv, "users")
+
+	p, err := NewPubSubPublisher("project", "users", "", pstestConn(t, srv))
+	if err != nil {
+		t.Fatalf("NewPubSubPublisher error: %v", err)
+	}
+	defer p.Close()
+
+	added := userEvent(watcher_models.USER_ADDED, "user-1", 0)
+	added.After = watcher_models.UserSnapshot{"email": "ex@vv.com"}
+	added.RequestID = "request-1"
+	deleted := userEvent(watcher_models.USER_DELETED, "user-2", 1)
+	deleted.Before = watcher_models.UserSnapshot{"nickname": "face"}
+	modified := userEvent(watcher_models.USER_MODIFIED, "user-1", 2)
+	modified.ChangedFields = []string{"email"}
+	sent := []*watcher_models.ChangeEvent{added, deleted, modified}
+	for _, event := range sent {
+		if err := p.Publish(context.Background(), event); err != nil {
+			t.Fatalf("Publish error: %v", err)
+		}
+	}
+
+	messages := srv.Messages()
+	if len(messages) != len(sent) {
+		t.Fatalf("got %d messages, want %d", len(messages), len(sent))
+	}
+	for i, msg := range messages {
+		var got watcher_models.ChangeEvent
+		if err := json.Unmarshal(msg.Data, &got); err != nil {
+			t.Fatalf("message %d isn't the JSON event: %v", i, err)
+		}
+		if !reflect.DeepEqual(&got, sent[i]) {
+			t.Errorf("event %d = %+v, want %+v", i, got, sent[i])
+		}
+		// the events of the user are delivered in order
+		if msg.OrderingKey != sent[i].UserID {
+			t.Errorf("ordering key %d = %q, want %q", i, msg.OrderingKey, sent[i].UserID)
+		}
+		// the attributes are read without decoding the data
+		want := map[string]string{
+			"schema_version": "1",
+			"type":           string(sent[i].Type),
+			"user_id":        sent[i].UserID,
+			"request_id":     sent[i].RequestID,
+		}
+		if !reflect.DeepEqual(msg.Attributes, want) {
+			t.Errorf("attributes %d = %v, want %v", i, msg.Attributes, want)
+		}
+	}
+}
+
+func TestPubSubPublisherResumeKey(t *testing.T) {
+	srv := runPstest(t)
+	createTopic(t, srv, "users")
+
+	p, err := NewPubSubPublisher("project", "users", "", pstestConn(t, srv))
+	if err != nil {
+		t.Fatalf("NewPubSubPublisher error: %v", err)
+	}
+	defer p.Close()
+
+	// the publishing fails while the topic is deleted
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.Client.Topic("users").Delete(ctx); err != nil {
+		t.Fatalf("failed to delete the topic: %v", err)
+	}
+	if err := p.Publish(ctx, userEvent(watcher_models.USER_ADDED, "user-1", 0)); err == nil {
+		t.Fatal("Publish error = nil, want the missing topic")
+	}
+	// the ordering key isn't paused after the failure
+	createTopic(t, srv, "users")
+	if err := p.Publish(ctx, userEvent(watcher_models.USER_MODIFIED, "user-1", 1)); err != nil {
+		t.Fatalf("Publish after the failure error: %v", err)
+	}
+}
+
+func TestNewPubSubPublisherTopic(t *testing.T) {
+	tests := []struct {
+		name     string
+		emulator bool
+		wantErr  bool
+	}{
+		// the topic isn't created in the real project
+		{name: "missing topic", wantErr: true},
+		{name: "emulator creates topic", emulator: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := runPstest(t)
+			emulator := ""
+			if tt.emulator {
+				emulator = srv.Addr
+			}
+			t.Setenv("PUBSUB_EMULATOR_HOST", emulator)
+
+			p, err := NewPubSubPublisher("project", "users", "", pstestConn(t, srv))
+			if tt.wantErr {
+				if err == nil {
+					p.Close()
+					t.Fatal("NewPubSubPublisher error = nil, want the missing topic")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewPubSubPublisher error: %v", err)
+			}
+			defer p.Close()
+			exists, err := p.Client.Topic("users").Exists(context.Background())
+			if err != nil || !exists {
+				t.Errorf("topic exists = %v, %v, want true", exists, err)
+			}
+		})
+	}
+}
+
+func TestPubSubPublisherWithoutProject(t *testing.T) {
+	p, err := NewPubSubPublisher("", "", "")
+	if err != nil {
+		t.Fatalf("NewPubSubPublisher error: %v", err)
+	}
+	defer p.Close()
+	if p.Client != nil {
+		t.Fatal("the client is created without the project")
+	}
+	// the event is only logged
+	event := userEvent(watcher_models.USER_ADDED, "user-1", 0)
+	if err := p.Publish(context.Background(), event); err != nil {
+		t.Errorf("Publish error: %v", err)
+	}
+}
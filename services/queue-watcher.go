@@ -0,0 +1,78 @@
+package services
+
+import (
+	"api/consts"
+	watcher_models "api/models/watcher"
+	"context"
+	"log"
+	"time"
+)
+
+// QueueWatcher publishes the events of the queue
+// through the publisher of the backend
+type QueueWatcher struct {
+	// queue of the events to publish
+	Queue     watcher_models.IEventQueue
+	Publisher watcher_models.IPublisher
+	// closed when Listen returns
+	done chan struct{}
+}
+
+// Init new QueueWatcher
+func NewQueueWatcher(queue watcher_models.IEventQueue,
+	publisher watcher_models.IPublisher) *QueueWatcher {
+
+	return &QueueWatcher{
+		Queue:     queue,
+		Publisher: publisher,
+		done:      make(chan struct{}),
+	}
+}
+
+// Close the Queue and the Publisher.
+// Events received before are published first.
+func (w *QueueWatcher) Close() {
+	w.Queue.Close()
+	// wait for the Listen
+	select {
+	case <-w.done:
+	case <-time.After(consts.WATCHER_CLOSE_TIMEOUT):
+		log.Printf("QueueWatcher: close timeout, some messages may be lost")
+	}
+	w.Publisher.Close()
+}
+
+// Start listen messages.
+// The func should run like a goroutine.
+func (w *QueueWatcher) Listen() {
+	defer close(w.done)
+
+	// goroutine for receiving
+	for {
+		event, ok := w.Queue.Pop()
+		if !ok {
+			return
+		}
+		// send the event to the backend
+		ctx, cancel := context.WithTimeout(context.Background(),
+			consts.WATCHER_PUBLISH_TIMEOUT)
+		err := w.Publisher.Publish(ctx, event)
+		cancel()
+		if err != nil {
+			log.Printf("QueueWatcher: failed to publish the event %s of the user %s: %v",
+				event.Type, event.UserID, err)
+		}
+	}
+}
+
+// Return the queue of the events
+func (w *QueueWatcher) GetQueue() watcher_models.IEventQueue {
+	return w.Queue
+}
+
+// Publish the event through the Publisher
+func (w *QueueWatcher) Publish(ctx context.Context,
+	event *watcher_models.ChangeEvent) error {
+
+	return w.Publisher.Publish(ctx, event)
+}
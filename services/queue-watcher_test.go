@@ -0,0 +1,94 @@
+package services
+
+import (
+	watcher_models "api/models/watcher"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Queue of the watcher tests
+func newTestQueue(t *testing.T) *EventQueue {
+	queue, err := NewEventQueue(16, watcher_models.BLOCK, "", time.Second, nil, nil)
+	if err != nil {
+		t.Fatalf("NewEventQueue error: %v", err)
+	}
+	return queue
+}
+
+// Event of the user change with the time of the n-th second
+func userEvent(typ watcher_models.EventType, userID string,
+	n int) *watcher_models.ChangeEvent {
+
+	return &watcher_models.ChangeEvent{
+		SchemaVersion: watcher_models.EVENT_SCHEMA_VERSION,
+		Type:          typ,
+		UserID:        userID,
+		Timestamp:     time.Date(2022, 10, 26, 10, 0, n, 0, time.UTC),
+	}
+}
+
+// Publisher keeping the events, the events of the failed users are rejected
+type recordingPublisher struct {
+	mu     sync.Mutex
+	events []*watcher_models.ChangeEvent
+	failed map[string]bool
+	closed bool
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context,
+	event *watcher_models.ChangeEvent) error {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failed[event.UserID] {
+		return errors.New("the backend rejected the event")
+	}
+	p.events = append(p.events, event)
+	return nil
+}
+
+func (p *recordingPublisher) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+}
+
+func TestQueueWatcherListen(t *testing.T) {
+	publisher := &recordingPublisher{failed: map[string]bool{"user-2": true}}
+	w := NewQueueWatcher(newTestQueue(t), publisher)
+	go w.Listen()
+
+	sent := []*watcher_models.ChangeEvent{
+		userEvent(watcher_models.USER_ADDED, "user-1", 0),
+		userEvent(watcher_models.USER_ADDED, "user-2", 1),
+		userEvent(watcher_models.USER_MODIFIED, "user-1", 2),
+	}
+	for _, event := range sent {
+		if err := w.GetQueue().Push(context.Background(), event); err != nil {
+			t.Fatalf("Push error: %v", err)
+		}
+	}
+	// the queued events are published before the publisher is closed
+	w.Close()
+
+	if !publisher.closed {
+		t.Error("the publisher isn't closed")
+	}
+	// the failed event doesn't stop the next ones
+	want := []*watcher_models.ChangeEvent{sent[0], sent[2]}
+	if len(publisher.events) != len(want) {
+		t.Fatalf("published %d events, want %d", len(publisher.events), len(want))
+	}
+	for i, event := range publisher.events {
+		if event != want[i] {
+			t.Errorf("event %d = %s of %s, want %s of %s", i,
+				event.Type, event.UserID, want[i].Type, want[i].UserID)
+		}
+	}
+	if err := w.GetQueue().Push(context.Background(), sent[0]); !errors.Is(err, watcher_models.ErrQueueClosed) {
+		t.Errorf("Push after Close error = %v, want %v", err, watcher_models.ErrQueueClosed)
+	}
+}
@@ -0,0 +1,92 @@
+package services
+
+import (
+	"api/consts"
+	metric_models "api/models/metric"
+	store_models "api/models/store"
+	"context"
+	"log"
+	"time"
+)
+
+// TombstonePurger hard-deletes the users which are soft deleted
+// longer than the retention period
+type TombstonePurger struct {
+	Store store_models.IPurgeStore
+	// deleted users are kept for this period
+	Retention time.Duration
+	// how often the deleted users are purged
+	Interval time.Duration
+	// purged users metric
+	PurgedMetric metric_models.IMetricCount
+	// closed by Stop
+	stop chan struct{}
+	// closed when Start returns
+	done chan struct{}
+}
+
+// Init new TombstonePurger,
+// STORE_DELETED_RETENTION and STORE_PURGE_INTERVAL are used by default
+func NewTombstonePurger(store store_models.IPurgeStore, retention time.Duration,
+	interval time.Duration, purged metric_models.IMetricCount) *TombstonePurger {
+
+	if retention <= 0 {
+		retention = consts.STORE_DELETED_RETENTION
+	}
+	if interval <= 0 {
+		interval = consts.STORE_PURGE_INTERVAL
+	}
+	return &TombstonePurger{
+		Store:        store,
+		Retention:    retention,
+		Interval:     interval,
+		PurgedMetric: purged,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// Start purge the deleted users.
+// The func should run like a goroutine.
+func (p *TombstonePurger) Start() {
+	defer close(p.done)
+
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		p.purge()
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop the purger, the purge in progress is finished first
+func (p *TombstonePurger) Stop() {
+	close(p.stop)
+	select {
+	case <-p.done:
+	case <-time.After(consts.WATCHER_CLOSE_TIMEOUT):
+		log.Printf("TombstonePurger: stop timeout")
+	}
+}
+
+// Delete the users deleted before the retention period,
+// the failed purge is repeated on the next tick
+func (p *TombstonePurger) purge() {
+	purged, err := p.Store.PurgeDeleted(context.Background(),
+		time.Now().Add(-p.Retention))
+	if err != nil {
+		log.Printf("TombstonePurger: failed to purge the deleted users: %v", err)
+		return
+	}
+	if purged == 0 {
+		return
+	}
+	log.Printf("TombstonePurger: %d deleted users are purged", purged)
+	if p.PurgedMetric != nil {
+		p.PurgedMetric.Add(float64(purged))
+	}
+}
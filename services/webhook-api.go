@@ -0,0 +1,99 @@
+package services
+
+import (
+	"api/consts"
+	watcher_models "api/models/watcher"
+	webhook_models "api/models/webhook"
+	"api/util"
+	"context"
+	"errors"
+	"net/http"
+
+	pb "api/proto/gen/go"
+
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// Register the webhook receiving the change events
+func (s *Server) RegisterWebhook(ctx context.Context,
+	request *pb.Webhook) (*pb.WebhookResponse, error) {
+	// check request
+	if request.Id != "" || request.CreatedAt != "" {
+		return s.webhookFailure("", badRequest("id and created_at must not set"))
+	}
+	webhook := &webhook_models.Webhook{
+		URL:    request.Url,
+		Secret: request.Secret,
+	}
+	for _, t := range request.Events {
+		webhook.Events = append(webhook.Events, watcher_models.EventType(t))
+	}
+	// check the webhook fields
+	if violations := s.WebhookValidator.Validate(webhook); len(violations) != 0 {
+		return s.webhookFailure("", invalidFields(util.ConvertViolations(violations)))
+	}
+	// save the webhook
+	if err := s.Webhooks.Register(ctx, webhook); err != nil {
+		// return error
+		return s.webhookFailure("", s.storeError("RegisterWebhook", "", err))
+	}
+	s.Logger.Info("RegisterWebhook:", webhook.ID)
+	return &pb.WebhookResponse{
+		Id:     webhook.ID,
+		Status: http.StatusOK,
+	}, nil
+}
+
+// Get the list of the webhooks, secrets are not returned
+func (s *Server) ListWebhooks(ctx context.Context,
+	request *emptypb.Empty) (*pb.WebhooksList, error) {
+
+	webhooks, err := s.Webhooks.List(ctx)
+	if err != nil {
+		// return error
+		return s.webhooksListFailure(s.storeError("ListWebhooks", "", err))
+	}
+	list := make([]*pb.Webhook, 0, len(webhooks))
+	for _, w := range webhooks {
+		webhook := &pb.Webhook{
+			Id:  w.ID,
+			Url: w.URL,
+		}
+		for _, t := range w.Events {
+			webhook.Events = append(webhook.Events, string(t))
+		}
+		if !w.CreatedAt.IsZero() {
+			webhook.CreatedAt = w.CreatedAt.Format(consts.TIME_FORMAT)
+		}
+		list = append(list, webhook)
+	}
+	return &pb.WebhooksList{
+		Webhook: list,
+		Status:  http.StatusOK,
+	}, nil
+}
+
+// Delete the registered webhook by ID
+func (s *Server) DeleteWebhook(ctx context.Context,
+	request *pb.Webhook) (*pb.WebhookResponse, error) {
+	// check request
+	if request.Id == "" {
+		return s.webhookFailure("", badRequest("the id field not set"))
+	}
+	err := s.Webhooks.Delete(ctx, request.Id)
+	switch {
+	case err == nil:
+	case errors.Is(err, webhook_models.ErrWebhookNotFound):
+		return s.webhookFailure(request.Id, notFound(request.Id))
+	case errors.Is(err, webhook_models.ErrWebhookReadOnly):
+		return s.webhookFailure(request.Id, readOnly(err))
+	default:
+		// return error
+		return s.webhookFailure(request.Id, s.storeError("DeleteWebhook", request.Id, err))
+	}
+	s.Logger.Info("DeleteWebhook:", request.Id)
+	return &pb.WebhookResponse{
+		Id:     request.Id,
+		Status: http.StatusOK,
+	}, nil
+}
@@ -0,0 +1,440 @@
+package services
+
+import (
+	"api/consts"
+	watcher_models "api/models/watcher"
+	webhook_models "api/models/webhook"
+	"api/util"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+WebhookPublisher delivers the events to the subscribed webhooks.
+The deliveries of the event wait in the bounded queue for one of the workers,
+the full queue blocks the publishing. The event is acked after all its
+deliveries are done or saved as the dead letters.
+It's also the registry of the webhooks for the admin requests.
+*/
+type WebhookPublisher struct {
+	// webhooks of the config
+	Static []*webhook_models.Webhook
+	// store of the registered webhooks and the dead letters
+	Store  webhook_models.IWebhookStore
+	Client *http.Client
+	// the delivery is dead after MaxAttempts failures
+	MaxAttempts int
+	// how often the registered webhooks are loaded from the store
+	ReloadInterval time.Duration
+	// the webhooks can be sent to the private or the loopback addresses
+	AllowPrivateHosts bool
+
+	// cache of the registered webhooks
+	mu         sync.Mutex
+	registered []*webhook_models.Webhook
+	loadedAt   time.Time
+
+	// deliveries in progress and the finished ones not acked yet by the delivery ID,
+	// the event published again waits for them instead of the new deliveries
+	inflight   map[string]*delivery
+	inflightMu sync.Mutex
+
+	// queued deliveries of the events, the queue isn't written after the close
+	queue     chan []*delivery
+	queueMu   sync.RWMutex
+	isClosed  bool
+	wg        sync.WaitGroup
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Delivery of the event to the webhook
+type delivery struct {
+	id      string
+	webhook *webhook_models.Webhook
+	event   *watcher_models.ChangeEvent
+	data    []byte
+	// closed when the event is delivered or saved as the dead letter
+	done chan struct{}
+	// the dead letter isn't saved, set before done is closed
+	err        error
+	finishedAt time.Time
+}
+
+/*
+Init new WebhookPublisher and start the workers of the deliveries.
+The webhooks of the config without ID get the ID "config-<index>".
+WEBHOOK_WORKERS and WEBHOOK_QUEUE_SIZE are used by default.
+*/
+func NewWebhookPublisher(static []*webhook_models.Webhook,
+	store webhook_models.IWebhookStore, timeout time.Duration,
+	maxAttempts int, workers int, queueSize int) *WebhookPublisher {
+
+	for i, webhook := range static {
+		if webhook.ID == "" {
+			webhook.ID = fmt.Sprintf("config-%d", i)
+		}
+	}
+	if timeout <= 0 {
+		timeout = consts.WEBHOOK_TIMEOUT
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = consts.WEBHOOK_MAX_ATTEMPTS
+	}
+	if workers <= 0 {
+		workers = consts.WEBHOOK_WORKERS
+	}
+	if queueSize <= 0 {
+		queueSize = consts.WEBHOOK_QUEUE_SIZE
+	}
+	p := &WebhookPublisher{
+		Static:         static,
+		Store:          store,
+		MaxAttempts:    maxAttempts,
+		ReloadInterval: consts.WEBHOOK_RELOAD_INTERVAL,
+		inflight:       make(map[string]*delivery),
+		queue:          make(chan []*delivery, queueSize),
+		closed:         make(chan struct{}),
+	}
+	// the proxy isn't used, the dialed addresses are checked
+	dialer := &net.Dialer{Timeout: timeout, Control: p.dialControl}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	p.Client = &http.Client{Timeout: timeout, Transport: transport}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+/*
+Deliver the event to every subscribed webhook and wait for the deliveries.
+The deliveries of the event are queued at once or not at all,
+the full queue blocks until the ctx is done.
+The workers deliver them, so the slow endpoint doesn't block the others.
+If the ctx is done before the deliveries, they go on: the event published
+again waits for them and doesn't repeat the delivered ones.
+*/
+func (p *WebhookPublisher) Publish(ctx context.Context,
+	event *watcher_models.ChangeEvent) error {
+
+	data, err := event.Marshal()
+	if err != nil {
+		return err
+	}
+	webhooks := p.webhooks()
+
+	p.queueMu.RLock()
+	if p.isClosed {
+		p.queueMu.RUnlock()
+		return fmt.Errorf("webhook: the publisher is closed")
+	}
+	deliveries, added := p.track(webhooks, event, data)
+	if len(added) != 0 {
+		select {
+		case p.queue <- added:
+		case <-ctx.Done():
+			p.untrack(added)
+			p.queueMu.RUnlock()
+			return fmt.Errorf("webhook: the delivery queue is full: %v", ctx.Err())
+		}
+	}
+	p.queueMu.RUnlock()
+
+	var errs []error
+	for _, d := range deliveries {
+		select {
+		case <-d.done:
+		case <-ctx.Done():
+			return fmt.Errorf("webhook: the delivery isn't finished: %v", ctx.Err())
+		}
+		if d.err != nil {
+			errs = append(errs, d.err)
+		}
+	}
+	p.untrack(deliveries)
+	return util.JoinErrors(errs)
+}
+
+// Stop the retries and wait for the running deliveries.
+// The stopped and the queued deliveries are saved as the dead letters.
+func (p *WebhookPublisher) Close() {
+	p.closeOnce.Do(func() {
+		p.queueMu.Lock()
+		p.isClosed = true
+		p.queueMu.Unlock()
+		close(p.closed)
+	})
+	p.wg.Wait()
+	for {
+		select {
+		case deliveries := <-p.queue:
+			for _, d := range deliveries {
+				p.finish(d, p.deadLetter(d, 0,
+					fmt.Errorf("the publisher is closed before the delivery")))
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Register the new webhook in the store
+func (p *WebhookPublisher) Register(ctx context.Context,
+	webhook *webhook_models.Webhook) error {
+
+	if p.Store == nil {
+		return fmt.Errorf("webhook: the store is not set")
+	}
+	webhook.ID = string(util.GenID())
+	webhook.CreatedAt = time.Now().UTC()
+	if err := p.Store.AddWebhook(ctx, webhook); err != nil {
+		return err
+	}
+	p.reload()
+	return nil
+}
+
+// Return the webhooks of the config and the registered ones
+func (p *WebhookPublisher) List(ctx context.Context) ([]*webhook_models.Webhook, error) {
+	webhooks := append([]*webhook_models.Webhook{}, p.Static...)
+	if p.Store == nil {
+		return webhooks, nil
+	}
+	registered, err := p.Store.ListWebhooks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return append(webhooks, registered...), nil
+}
+
+// Delete the registered webhook, the webhooks of the config can't be deleted
+func (p *WebhookPublisher) Delete(ctx context.Context, id string) error {
+	for _, webhook := range p.Static {
+		if webhook.ID == id {
+			return webhook_models.ErrWebhookReadOnly
+		}
+	}
+	if p.Store == nil {
+		return webhook_models.ErrWebhookNotFound
+	}
+	if err := p.Store.DeleteWebhook(ctx, id); err != nil {
+		return err
+	}
+	p.reload()
+	return nil
+}
+
+// Return the webhooks of the config and the cached registered ones.
+// The cache is loaded again after the ReloadInterval,
+// the old cache is used if the store fails.
+func (p *WebhookPublisher) webhooks() []*webhook_models.Webhook {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.Store != nil && time.Since(p.loadedAt) >= p.ReloadInterval {
+		registered, err := p.Store.ListWebhooks(context.Background())
+		if err != nil {
+			log.Printf("WebhookPublisher: failed to load the webhooks: %v", err)
+		} else {
+			p.registered = registered
+		}
+		p.loadedAt = time.Now()
+	}
+	return append(append([]*webhook_models.Webhook{}, p.Static...), p.registered...)
+}
+
+// Load the registered webhooks on the next event
+func (p *WebhookPublisher) reload() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.loadedAt = time.Time{}
+}
+
+/*
+Return the deliveries of the event to the webhooks and the added ones.
+The deliveries in progress and the finished ones are reused,
+the delivery is added again if its dead letter isn't saved.
+The finished deliveries which aren't acked are forgotten after WEBHOOK_ACK_TTL.
+*/
+func (p *WebhookPublisher) track(webhooks []*webhook_models.Webhook,
+	event *watcher_models.ChangeEvent, data []byte) (deliveries, added []*delivery) {
+
+	p.inflightMu.Lock()
+	defer p.inflightMu.Unlock()
+
+	for id, d := range p.inflight {
+		if !d.finishedAt.IsZero() && time.Since(d.finishedAt) > consts.WEBHOOK_ACK_TTL {
+			delete(p.inflight, id)
+		}
+	}
+	for _, webhook := range webhooks {
+		if !webhook.Subscribed(event.Type) {
+			continue
+		}
+		id := deliveryID(webhook, event)
+		d, ok := p.inflight[id]
+		if !ok || d.err != nil {
+			d = &delivery{id: id, webhook: webhook, event: event, data: data,
+				done: make(chan struct{})}
+			p.inflight[id] = d
+			added = append(added, d)
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, added
+}
+
+// Forget the deliveries
+func (p *WebhookPublisher) untrack(deliveries []*delivery) {
+	p.inflightMu.Lock()
+	defer p.inflightMu.Unlock()
+	for _, d := range deliveries {
+		if p.inflight[d.id] == d {
+			delete(p.inflight, d.id)
+		}
+	}
+}
+
+// Set the result of the delivery, the error means it isn't saved
+func (p *WebhookPublisher) finish(d *delivery, err error) {
+	p.inflightMu.Lock()
+	defer p.inflightMu.Unlock()
+	d.err = err
+	d.finishedAt = time.Now()
+	close(d.done)
+}
+
+// Deliver the queued events until the publisher is closed
+func (p *WebhookPublisher) work() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.closed:
+			return
+		case deliveries := <-p.queue:
+			var wg sync.WaitGroup
+			wg.Add(len(deliveries))
+			for _, d := range deliveries {
+				go func(d *delivery) {
+					defer wg.Done()
+					p.finish(d, p.deliver(d))
+				}(d)
+			}
+			wg.Wait()
+		}
+	}
+}
+
+// Deliver the event to the webhook with the exponential backoff.
+// The dead letter is saved after MaxAttempts failures,
+// the error is returned if it isn't saved.
+func (p *WebhookPublisher) deliver(d *delivery) error {
+	var err error
+	attempts := 0
+	for attempts < p.MaxAttempts {
+		if attempts > 0 {
+			delay := backoff(attempts-1,
+				consts.WATCHER_RETRY_MIN_DELAY, consts.WATCHER_RETRY_MAX_DELAY)
+			select {
+			case <-p.closed:
+				err = fmt.Errorf("the publisher is closed after the error: %v", err)
+				return p.deadLetter(d, attempts, err)
+			case <-time.After(delay):
+			}
+		}
+		attempts++
+		if err = p.post(d.webhook, d.id, d.event, d.data); err == nil {
+			return nil
+		}
+		log.Printf("WebhookPublisher: failed to deliver %s to the webhook %s (attempt %d): %v",
+			d.id, d.webhook.ID, attempts, err)
+	}
+	return p.deadLetter(d, attempts, err)
+}
+
+// Block the connections to the addresses which aren't public.
+// The address is already resolved, so the host name can't be changed
+// to the private address after the check.
+func (p *WebhookPublisher) dialControl(network, address string, _ syscall.RawConn) error {
+	if p.AllowPrivateHosts {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !util.PublicIP(ip) {
+		return fmt.Errorf("webhook: the address %s is not public", host)
+	}
+	return nil
+}
+
+// The delivery ID is made of the event ID, so it's the same
+// when the event is published again
+func deliveryID(webhook *webhook_models.Webhook, event *watcher_models.ChangeEvent) string {
+	return event.ID + "." + webhook.ID
+}
+
+// Send the event to the webhook, any 2xx status is the success
+func (p *WebhookPublisher) post(webhook *webhook_models.Webhook, deliveryID string,
+	event *watcher_models.ChangeEvent, data []byte) error {
+
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", deliveryID)
+	req.Header.Set("X-Webhook-Event", string(event.Type))
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature",
+		util.WebhookSignature(webhook.Secret, timestamp, data))
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	// read the body to reuse the connection
+	io.Copy(io.Discard, io.LimitReader(resp.Body, consts.WEBHOOK_MAX_RESPONSE_SIZE))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Save the failed delivery, the error is returned if it isn't saved
+func (p *WebhookPublisher) deadLetter(d *delivery, attempts int, err error) error {
+	log.Printf("WebhookPublisher: the delivery to the webhook %s is dead after %d attempts: %v",
+		d.webhook.ID, attempts, err)
+	if p.Store == nil {
+		return fmt.Errorf("webhook: the delivery %s failed: %v", d.id, err)
+	}
+	letter := &webhook_models.DeadLetter{
+		ID:        d.id,
+		WebhookID: d.webhook.ID,
+		URL:       d.webhook.URL,
+		Event:     string(d.data),
+		Attempts:  attempts,
+		LastError: err.Error(),
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := p.Store.AddDeadLetter(context.Background(), letter); err != nil {
+		log.Printf("WebhookPublisher: failed to save the dead letter: %v", err)
+		return fmt.Errorf("webhook: failed to save the dead letter %s: %v", d.id, err)
+	}
+	return nil
+}
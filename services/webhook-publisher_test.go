@@ -0,0 +1,197 @@
+package services
+
+import (
+	watcher_models "api/models/watcher"
+	webhook_models "api/models/webhook"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Store of the dead letters in the memory
+type memoryWebhookStore struct {
+	mu      sync.Mutex
+	letters []*webhook_models.DeadLetter
+	// error of saving the dead letter
+	err error
+}
+
+func (s *memoryWebhookStore) AddWebhook(context.Context, *webhook_models.Webhook) error {
+	return nil
+}
+
+func (s *memoryWebhookStore) ListWebhooks(context.Context) ([]*webhook_models.Webhook, error) {
+	return nil, nil
+}
+
+func (s *memoryWebhookStore) DeleteWebhook(ctx context.Context, id string) error {
+	return webhook_models.ErrWebhookNotFound
+}
+
+func (s *memoryWebhookStore) AddDeadLetter(ctx context.Context,
+	letter *webhook_models.DeadLetter) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.letters = append(s.letters, letter)
+	return nil
+}
+
+// Endpoint counting the deliveries, the requests wait for the release
+type webhookEndpoint struct {
+	status  int
+	release chan struct{}
+
+	mu         sync.Mutex
+	deliveries map[string]int
+}
+
+func (e *webhookEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if e.release != nil {
+		<-e.release
+	}
+	e.mu.Lock()
+	e.deliveries[r.Header.Get("X-Webhook-Id")]++
+	e.mu.Unlock()
+	w.WriteHeader(e.status)
+}
+
+func (e *webhookEndpoint) count() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	n := 0
+	for _, c := range e.deliveries {
+		n += c
+	}
+	return n
+}
+
+// Publisher of the webhooks to the test server
+func newTestWebhookPublisher(t *testing.T, endpoint *webhookEndpoint,
+	store *memoryWebhookStore, webhooks int, workers int) *WebhookPublisher {
+
+	endpoint.deliveries = make(map[string]int)
+	srv := httptest.NewServer(endpoint)
+	t.Cleanup(srv.Close)
+	var static []*webhook_models.Webhook
+	for i := 0; i < webhooks; i++ {
+		static = append(static, &webhook_models.Webhook{URL: srv.URL,
+			Secret: "0123456789abcdef"})
+	}
+	p := NewWebhookPublisher(static, store, time.Second, 1, workers, 1)
+	p.AllowPrivateHosts = true
+	return p
+}
+
+// Event with the ID like the outbox gives
+func webhookEvent(n int) *watcher_models.ChangeEvent {
+	event := userEvent(watcher_models.USER_ADDED, "user-1", n)
+	event.ID = "event-" + string(rune('a'+n))
+	return event
+}
+
+func TestWebhookPublisherAck(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		storeErr error
+		letters  int
+		wantErr  bool
+	}{
+		{name: "delivered", status: http.StatusNoContent},
+		{name: "dead letter saved", status: http.StatusInternalServerError, letters: 1},
+		// the event is published again
+		{name: "dead letter not saved", status: http.StatusInternalServerError,
+			storeErr: errors.New("the store is down"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint := &webhookEndpoint{status: tt.status}
+			store := &memoryWebhookStore{err: tt.storeErr}
+			p := newTestWebhookPublisher(t, endpoint, store, 1, 1)
+			defer p.Close()
+
+			err := p.Publish(context.Background(), webhookEvent(0))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Publish error = %v, want the error %t", err, tt.wantErr)
+			}
+			// the delivery is finished before the ack
+			if endpoint.count() != 1 {
+				t.Errorf("delivered %d times before the ack, want 1", endpoint.count())
+			}
+			if len(store.letters) != tt.letters {
+				t.Errorf("saved %d dead letters, want %d", len(store.letters), tt.letters)
+			}
+		})
+	}
+}
+
+func TestWebhookPublisherTimeout(t *testing.T) {
+	endpoint := &webhookEndpoint{status: http.StatusOK, release: make(chan struct{})}
+	p := newTestWebhookPublisher(t, endpoint, &memoryWebhookStore{}, 2, 1)
+	defer p.Close()
+
+	event := webhookEvent(0)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := p.Publish(ctx, event); err == nil {
+		t.Fatal("Publish error = nil, want the timeout before the delivery")
+	}
+	close(endpoint.release)
+	// the event published again waits for the same deliveries
+	if err := p.Publish(context.Background(), event); err != nil {
+		t.Fatalf("Publish error: %v", err)
+	}
+	if len(endpoint.deliveries) != 2 {
+		t.Errorf("deliveries = %v, want one per webhook", endpoint.deliveries)
+	}
+	for id, n := range endpoint.deliveries {
+		if n != 1 {
+			t.Errorf("the delivery %s is sent %d times", id, n)
+		}
+	}
+	// the acked event is delivered again only if it's published again
+	if err := p.Publish(context.Background(), event); err != nil {
+		t.Fatalf("Publish error: %v", err)
+	}
+	if endpoint.count() != 4 {
+		t.Errorf("delivered %d times, want 4", endpoint.count())
+	}
+}
+
+func TestWebhookPublisherFullQueue(t *testing.T) {
+	endpoint := &webhookEndpoint{status: http.StatusOK, release: make(chan struct{})}
+	p := newTestWebhookPublisher(t, endpoint, &memoryWebhookStore{}, 2, 1)
+	defer p.Close()
+
+	// the first event takes the worker and the second one the queue
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			results <- p.Publish(context.Background(), webhookEvent(i))
+		}(i)
+		time.Sleep(20 * time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := p.Publish(ctx, webhookEvent(2)); err == nil {
+		t.Fatal("Publish error = nil, want the full queue")
+	}
+	close(endpoint.release)
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("Publish error: %v", err)
+		}
+	}
+	// no delivery of the rejected event is queued
+	if len(endpoint.deliveries) != 4 {
+		t.Errorf("deliveries = %v, want two events to two webhooks", endpoint.deliveries)
+	}
+}
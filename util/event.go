@@ -0,0 +1,138 @@
+package util
+
+import (
+	"api/consts"
+	store_models "api/models/store"
+	user_models "api/models/user"
+	watcher_models "api/models/watcher"
+	"context"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/grpc/metadata"
+
+	pb "api/proto/gen/go"
+)
+
+// Metadata key of the request ID
+const requestIDKey = "x-request-id"
+
+/*
+Create the change event of the user.
+The before is the document before the change, nil for the added user.
+The update is the document written by the request, nil for the deleted user.
+The removed are the keys of the fields cleared by the request.
+*/
+func NewChangeEvent(ctx context.Context, eventType watcher_models.EventType,
+	id string, before store_models.IStoreGetResponse,
+	update store_models.IStoreGetResponse,
+	removed []string) *watcher_models.ChangeEvent {
+
+	event := &watcher_models.ChangeEvent{
+		ID:            string(GenID()),
+		SchemaVersion: watcher_models.EVENT_SCHEMA_VERSION,
+		Type:          eventType,
+		UserID:        id,
+		Timestamp:     time.Now().UTC(),
+		RequestID:     RequestID(ctx),
+	}
+	if before != nil {
+		event.Before = watcher_models.UserSnapshot(PublicUser(before))
+	}
+	if update == nil {
+		return event
+	}
+
+	// apply the update to the document before
+	after := make(store_models.IStoreGetResponse, len(before)+len(update))
+	for key, value := range before {
+		after[key] = value
+	}
+	for key, value := range update {
+		if key == "_id" || key == "updated_at" || key == "version" {
+			after[key] = value
+			continue
+		}
+		if !reflect.DeepEqual(before[key], value) {
+			event.ChangedFields = append(event.ChangedFields, key)
+		}
+		after[key] = value
+	}
+	if before != nil {
+		after["version"] = NextVersion(before)
+	}
+	for _, key := range removed {
+		if _, ok := before[key]; ok {
+			event.ChangedFields = append(event.ChangedFields, key)
+		}
+		delete(after, key)
+	}
+	sort.Strings(event.ChangedFields)
+	event.After = watcher_models.UserSnapshot(PublicUser(after))
+	return event
+}
+
+// Convert the user to the document as it's written to the store
+func UserDoc(user *user_models.User) (store_models.IStoreGetResponse, error) {
+	b, err := bson.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+	doc := make(store_models.IStoreGetResponse)
+	if err := bson.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Get the request ID from the metadata or generate the new one
+func RequestID(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(requestIDKey); len(ids) != 0 && ids[0] != "" {
+			return ids[0]
+		}
+	}
+	return string(GenID())
+}
+
+// Convert the change event to the message of the WatchUsers stream
+func ParseEventToPb(event *watcher_models.ChangeEvent) (*pb.UserEvent, error) {
+	pbEvent := &pb.UserEvent{
+		Id:            event.ID,
+		Type:          string(event.Type),
+		UserId:        event.UserID,
+		ChangedFields: event.ChangedFields,
+		Timestamp:     event.Timestamp.UTC().Format(consts.TIME_FORMAT),
+		RequestId:     event.RequestID,
+		Status:        http.StatusOK,
+	}
+	// the deleted user is the last known state
+	user, before := event.After, event.Before
+	if event.Type == watcher_models.USER_DELETED {
+		user, before = event.Before, nil
+	}
+	var err error
+	if pbEvent.User, err = parseSnapshot(user); err != nil {
+		return nil, err
+	}
+	if pbEvent.Before, err = parseSnapshot(before); err != nil {
+		return nil, err
+	}
+	return pbEvent, nil
+}
+
+// Convert the user snapshot, nil for the empty one
+func parseSnapshot(snapshot watcher_models.UserSnapshot) (*pb.User, error) {
+	if len(snapshot) == 0 {
+		return nil, nil
+	}
+	users, err := ParseUsersToPb(
+		[]store_models.IStoreGetResponse{store_models.IStoreGetResponse(snapshot)})
+	if err != nil {
+		return nil, err
+	}
+	return users[0], nil
+}
@@ -0,0 +1,87 @@
+package util
+
+import (
+	validator_models "api/models/validator"
+	"fmt"
+	"sort"
+
+	pb "api/proto/gen/go"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// Fields of the user which are set by the store, they can't be in the mask
+var readOnlyFields = map[string]bool{
+	"id":         true,
+	"created_at": true,
+	"updated_at": true,
+	"version":    true,
+	"deleted_at": true,
+}
+
+/*
+Split the update of the user by the mask.
+The set is the user with the fields of the mask which are set in the user,
+the unset are the fields of the mask which are empty in the user.
+The empty mask means all set fields of the user except the read-only ones.
+*/
+func ApplyUpdateMask(user *pb.User, mask *fieldmaskpb.FieldMask) (set *pb.User,
+	unset []string, violations []validator_models.FieldViolation) {
+
+	src := user.ProtoReflect()
+	fields := src.Descriptor().Fields()
+	set = &pb.User{Id: user.Id}
+	dst := set.ProtoReflect()
+
+	paths := mask.GetPaths()
+	if len(paths) == 0 {
+		src.Range(func(fd protoreflect.FieldDescriptor, _ protoreflect.Value) bool {
+			if !readOnlyFields[string(fd.Name())] {
+				paths = append(paths, string(fd.Name()))
+			}
+			return true
+		})
+	}
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		fd := fields.ByName(protoreflect.Name(path))
+		if fd == nil {
+			violations = append(violations, validator_models.FieldViolation{
+				Field:       "update_mask",
+				Description: fmt.Sprintf("unknown field %q", path),
+			})
+			continue
+		}
+		if readOnlyFields[path] {
+			violations = append(violations, validator_models.FieldViolation{
+				Field:       "update_mask",
+				Description: fmt.Sprintf("field %q is read-only", path),
+			})
+			continue
+		}
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		if src.Has(fd) {
+			dst.Set(fd, src.Get(fd))
+		} else {
+			unset = append(unset, path)
+		}
+	}
+	sort.Strings(unset)
+	return set, unset, violations
+}
+
+// Convert the field violations to pb
+func ConvertViolations(violations []validator_models.FieldViolation) []*pb.FieldViolation {
+	pbViolations := make([]*pb.FieldViolation, 0, len(violations))
+	for _, v := range violations {
+		pbViolations = append(pbViolations, &pb.FieldViolation{
+			Field:       v.Field,
+			Description: v.Description,
+		})
+	}
+	return pbViolations
+}
@@ -0,0 +1,68 @@
+package util
+
+import (
+	pb "api/proto/gen/go"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+func TestApplyUpdateMask(t *testing.T) {
+	user := &pb.User{Id: "u1", FirstName: "Bob", Email: "bob@corp.com",
+		Version: 3, CreatedAt: "2022-10-26T10:00:00Z"}
+	tests := []struct {
+		name       string
+		paths      []string
+		set        *pb.User
+		unset      []string
+		violations []string
+	}{
+		// the set fields except the read-only ones
+		{name: "empty mask", set: &pb.User{Id: "u1", FirstName: "Bob", Email: "bob@corp.com"}},
+		{name: "set and unset", paths: []string{"nickname", "first_name", "country"},
+			set: &pb.User{Id: "u1", FirstName: "Bob"}, unset: []string{"country", "nickname"}},
+		{name: "repeated path", paths: []string{"email", "email"},
+			set: &pb.User{Id: "u1", Email: "bob@corp.com"}},
+		{name: "unknown path", paths: []string{"first_name", "age", "FirstName"},
+			violations: []string{`unknown field "age"`, `unknown field "FirstName"`}},
+		{name: "nested path", paths: []string{"user.first_name"},
+			violations: []string{`unknown field "user.first_name"`}},
+		{name: "read-only", paths: []string{"id", "created_at", "updated_at",
+			"version", "deleted_at"}, violations: []string{
+			`field "id" is read-only`, `field "created_at" is read-only`,
+			`field "updated_at" is read-only`, `field "version" is read-only`,
+			`field "deleted_at" is read-only`}},
+		{name: "read-only with others", paths: []string{"email", "version"},
+			violations: []string{`field "version" is read-only`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mask *fieldmaskpb.FieldMask
+			if tt.paths != nil {
+				mask = &fieldmaskpb.FieldMask{Paths: tt.paths}
+			}
+			set, unset, violations := ApplyUpdateMask(user, mask)
+			var descriptions []string
+			for _, v := range violations {
+				if v.Field != "update_mask" {
+					t.Errorf("violation of %q, want update_mask", v.Field)
+				}
+				descriptions = append(descriptions, v.Description)
+			}
+			if !reflect.DeepEqual(descriptions, tt.violations) {
+				t.Errorf("violations = %q, want %q", descriptions, tt.violations)
+			}
+			if tt.violations != nil {
+				return
+			}
+			if !proto.Equal(set, tt.set) {
+				t.Errorf("set = %v, want %v", set, tt.set)
+			}
+			if !reflect.DeepEqual(unset, tt.unset) {
+				t.Errorf("unset = %v, want %v", unset, tt.unset)
+			}
+		})
+	}
+}
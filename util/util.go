@@ -1,16 +1,21 @@
 package util
 
 import (
+	"api/consts"
 	"encoding/json"
 	"regexp"
+	"time"
 
 	user_models "api/models/user"
 	pb "api/proto/gen/go"
 
+	filter_models "api/models/filter"
 	store_models "api/models/store"
 
 	"github.com/google/uuid"
 	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // matched origin
@@ -49,20 +54,144 @@ func ConvertUserReq(pbReq *pb.User) *user_models.User {
 
 }
 
-// convert pb UserFilter
-func ConvertUserFilter(pbReq *pb.UsersFilter) (inInterface map[string][]interface{}) {
+// convert pb UserFilter.
+// Only the list fields are kept, the paging, sort and conditions are skipped.
+func ConvertUserFilter(pbReq *pb.UsersFilter) map[string][]interface{} {
 
 	// convert the request to the map
+	var inInterface map[string]interface{}
 	inrec, _ := json.Marshal(pbReq)
 	json.Unmarshal(inrec, &inInterface)
 
+	filters := make(map[string][]interface{})
+	for key, value := range inInterface {
+		if values, ok := value.([]interface{}); ok {
+			filters[key] = values
+		}
+	}
+	delete(filters, "sort")
+	delete(filters, "conditions")
+
 	// set id key
-	if inInterface["id"] != nil {
-		inInterface["_id"] = inInterface["id"]
-		delete(inInterface, "id")
+	if filters["id"] != nil {
+		filters["_id"] = filters["id"]
+		delete(filters, "id")
+	}
+
+	return filters
+}
+
+// convert pb UserFilter to the filter input
+func ConvertFilterInput(pbReq *pb.UsersFilter) filter_models.Input {
+	return filter_models.Input{
+		In:         ConvertUserFilter(pbReq),
+		Ranges:     ConvertDateRanges(pbReq),
+		Conditions: ConvertConditions(pbReq.Conditions),
+		Expression: ConvertExpression(pbReq.Expression),
+	}
+}
+
+// convert pb filter expression of the UserFilter
+func ConvertExpression(pbExpr *pb.FilterExpression) *filter_models.Expression {
+	if pbExpr == nil {
+		return nil
+	}
+	expr := &filter_models.Expression{}
+	switch node := pbExpr.Node.(type) {
+	case *pb.FilterExpression_And:
+		expr.Type = filter_models.AND
+		expr.Children = convertExpressions(node.And.GetExpressions())
+	case *pb.FilterExpression_Or:
+		expr.Type = filter_models.OR
+		expr.Children = convertExpressions(node.Or.GetExpressions())
+	case *pb.FilterExpression_Not:
+		expr.Type = filter_models.NOT
+		expr.Children = convertExpressions([]*pb.FilterExpression{node.Not})
+	case *pb.FilterExpression_Condition:
+		expr.Type = filter_models.CONDITION
+		conds := ConvertConditions([]*pb.FieldCondition{node.Condition})
+		expr.Condition = &conds[0]
+	}
+	return expr
+}
+
+func convertExpressions(pbExprs []*pb.FilterExpression) []*filter_models.Expression {
+	exprs := make([]*filter_models.Expression, 0, len(pbExprs))
+	for _, e := range pbExprs {
+		if e != nil {
+			exprs = append(exprs, ConvertExpression(e))
+		}
+	}
+	return exprs
+}
+
+// pb operators of the field conditions
+var pbOperators = map[pb.FieldCondition_Operator]filter_models.Op{
+	pb.FieldCondition_EQ:       filter_models.EQ,
+	pb.FieldCondition_IN:       filter_models.IN,
+	pb.FieldCondition_NIN:      filter_models.NIN,
+	pb.FieldCondition_PREFIX:   filter_models.PREFIX,
+	pb.FieldCondition_SUFFIX:   filter_models.SUFFIX,
+	pb.FieldCondition_CONTAINS: filter_models.CONTAINS,
+	pb.FieldCondition_EXISTS:   filter_models.EXISTS,
+}
+
+// convert pb field conditions of the UserFilter
+func ConvertConditions(pbConds []*pb.FieldCondition) []filter_models.Condition {
+	conds := make([]filter_models.Condition, 0, len(pbConds))
+	for _, c := range pbConds {
+		values := make([]interface{}, 0, len(c.GetValues()))
+		for _, v := range c.GetValues() {
+			values = append(values, v)
+		}
+		conds = append(conds, filter_models.Condition{
+			Field:  c.GetField(),
+			Op:     pbOperators[c.GetOperator()],
+			Values: values,
+			Exists: c.GetExists(),
+		})
 	}
+	return conds
+}
 
-	return
+// convert pb sort of the UserFilter
+func ConvertSort(pbSort []*pb.SortField) []filter_models.SortField {
+	sort := make([]filter_models.SortField, 0, len(pbSort))
+	for _, s := range pbSort {
+		sort = append(sort, filter_models.SortField{
+			Field: s.Field,
+			Desc:  s.Direction == pb.SortField_DESC,
+		})
+	}
+	return sort
+}
+
+// convert pb date ranges of the UserFilter
+func ConvertDateRanges(pbReq *pb.UsersFilter) []filter_models.Range {
+	var ranges []filter_models.Range
+	if pbReq.CreatedAfter != nil || pbReq.CreatedBefore != nil {
+		ranges = append(ranges, filter_models.Range{
+			Field: "created_at",
+			From:  convertTimestamp(pbReq.CreatedAfter),
+			To:    convertTimestamp(pbReq.CreatedBefore),
+		})
+	}
+	if pbReq.UpdatedAfter != nil || pbReq.UpdatedBefore != nil {
+		ranges = append(ranges, filter_models.Range{
+			Field: "updated_at",
+			From:  convertTimestamp(pbReq.UpdatedAfter),
+			To:    convertTimestamp(pbReq.UpdatedBefore),
+		})
+	}
+	return ranges
+}
+
+// convert pb timestamp, nil is the zero time
+func convertTimestamp(ts *timestamppb.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+	return ts.AsTime()
 }
 
 // Generate new users uuid ID
@@ -100,12 +229,7 @@ func ParseUsersToPb(
 
 	// decode results
 	for _, res := range results {
-		// set id key
-		if res["_id"] != nil {
-			res["id"] = res["_id"]
-			delete(res, "_id")
-		}
-		jsonString, err := json.Marshal(res)
+		jsonString, err := json.Marshal(PublicUser(res))
 		if err != nil {
 			return nil, err
 		}
@@ -117,3 +241,24 @@ func ParseUsersToPb(
 	}
 	return usersResults, nil
 }
+
+// Copy the user document in the API format:
+// the id key is set, dates are formatted and the password hash is stripped
+func PublicUser(res store_models.IStoreGetResponse) store_models.IStoreGetResponse {
+	public := make(store_models.IStoreGetResponse, len(res))
+	for key, value := range res {
+		// format dates, old documents keep dates as strings
+		if date, ok := value.(primitive.DateTime); ok {
+			value = date.Time().UTC().Format(consts.TIME_FORMAT)
+		}
+		public[key] = value
+	}
+	// set id key
+	if public["_id"] != nil {
+		public["id"] = public["_id"]
+		delete(public, "_id")
+	}
+	// the password hash is never returned
+	delete(public, "password")
+	return public
+}
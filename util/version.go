@@ -0,0 +1,61 @@
+package util
+
+import (
+	store_models "api/models/store"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// Metadata key of the expected version, the gateway sets it from the If-Match header
+const ifMatchKey = "if-match"
+
+// Return the version of the document after the change,
+// the documents created before the versions have the version 0
+func NextVersion(before store_models.IStoreGetResponse) int64 {
+	switch v := before["version"].(type) {
+	case int32:
+		return int64(v) + 1
+	case int64:
+		return v + 1
+	case float64:
+		return int64(v) + 1
+	}
+	return 1
+}
+
+/*
+Get the expected version of the changed user.
+The version of the request is used if it's set,
+otherwise the ETag of the If-Match metadata, e.g. "3".
+The 0 and "*" mean any version.
+*/
+func ExpectedVersion(ctx context.Context, version int64) (int64, error) {
+	if version < 0 {
+		return 0, fmt.Errorf("the version must not be negative")
+	}
+	if version > 0 {
+		return version, nil
+	}
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return 0, nil
+	}
+	values := md.Get(ifMatchKey)
+	if len(values) == 0 {
+		return 0, nil
+	}
+	etag := strings.TrimSpace(values[0])
+	if etag == "*" || etag == "" {
+		return 0, nil
+	}
+	etag = strings.Trim(strings.TrimPrefix(etag, "W/"), `"`)
+	v, err := strconv.ParseInt(etag, 10, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("invalid If-Match: %q", values[0])
+	}
+	return v, nil
+}
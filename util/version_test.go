@@ -0,0 +1,79 @@
+package util
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+)
+
+func TestExpectedVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int64
+		ifMatch []string
+		want    int64
+		wantErr bool
+	}{
+		{name: "no version"},
+		{name: "request version", version: 3, want: 3},
+		// the version of the request wins over the header
+		{name: "request and header", version: 3, ifMatch: []string{`"5"`}, want: 3},
+		{name: "negative version", version: -1, wantErr: true},
+		{name: "quoted etag", ifMatch: []string{`"5"`}, want: 5},
+		{name: "weak etag", ifMatch: []string{`W/"5"`}, want: 5},
+		{name: "spaces", ifMatch: []string{` "5" `}, want: 5},
+		{name: "bare etag", ifMatch: []string{"5"}, want: 5},
+		{name: "any version", ifMatch: []string{"*"}},
+		{name: "empty header", ifMatch: []string{""}},
+		{name: "first etag", ifMatch: []string{`"5"`, `"6"`}, want: 5},
+		{name: "not a number", ifMatch: []string{`"abc"`}, wantErr: true},
+		{name: "zero etag", ifMatch: []string{`"0"`}, wantErr: true},
+		{name: "negative etag", ifMatch: []string{`"-2"`}, wantErr: true},
+		{name: "list of etags", ifMatch: []string{`"5", "6"`}, wantErr: true},
+		{name: "float etag", ifMatch: []string{`"5.0"`}, wantErr: true},
+		{name: "overflow", ifMatch: []string{`"99999999999999999999"`}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.ifMatch != nil {
+				md := metadata.MD{}
+				md.Append(ifMatchKey, tt.ifMatch...)
+				ctx = metadata.NewIncomingContext(ctx, md)
+			}
+			got, err := ExpectedVersion(ctx, tt.version)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ExpectedVersion error = %v, want the error %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ExpectedVersion = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		version interface{}
+		want    int64
+	}{
+		// the users created before the versions
+		{name: "no version", want: 1},
+		{name: "int32", version: int32(3), want: 4},
+		{name: "int64", version: int64(3), want: 4},
+		{name: "double", version: float64(3), want: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := map[string]interface{}{"_id": "u1"}
+			if tt.version != nil {
+				before["version"] = tt.version
+			}
+			if got := NextVersion(before); got != tt.want {
+				t.Errorf("NextVersion = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
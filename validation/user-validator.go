@@ -0,0 +1,106 @@
+package validation
+
+import (
+	"api/consts"
+	validator_models "api/models/validator"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	user_models "api/models/user"
+)
+
+var nicknameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// UserValidator checks the fields of the user.
+// The empty fields are not checked, they are not set in the store.
+type UserValidator struct {
+}
+
+// Validate the user fields, return all violations
+func (v *UserValidator) Validate(
+	user *user_models.User) (violations []validator_models.FieldViolation) {
+
+	add := func(field string, format string, a ...interface{}) {
+		violations = append(violations, validator_models.FieldViolation{
+			Field:       field,
+			Description: fmt.Sprintf(format, a...),
+		})
+	}
+
+	if desc := checkName(string(user.FirstName)); desc != "" {
+		add("first_name", desc)
+	}
+	if desc := checkName(string(user.LastName)); desc != "" {
+		add("last_name", desc)
+	}
+	if nickname := string(user.Nickname); nickname != "" {
+		if n := len(nickname); n < consts.VALIDATION_NICKNAME_MIN_LEN ||
+			n > consts.VALIDATION_NICKNAME_MAX_LEN {
+			add("nickname", "must be from %d to %d characters long",
+				consts.VALIDATION_NICKNAME_MIN_LEN, consts.VALIDATION_NICKNAME_MAX_LEN)
+		} else if !nicknameRegexp.MatchString(nickname) {
+			add("nickname", "may contain only latin letters, digits, '_', '.' and '-'")
+		}
+	}
+	if email := string(user.Email); email != "" {
+		if desc := checkEmail(email); desc != "" {
+			add("email", desc)
+		}
+	}
+	if country := string(user.Country); country != "" && !countryCodes[country] {
+		add("country", "must be the ISO 3166-1 alpha-2 code, e.g. \"DE\"")
+	}
+	if password := string(user.Password); password != "" {
+		if n := len(password); n < consts.VALIDATION_PASSWORD_MIN_LEN ||
+			n > consts.VALIDATION_PASSWORD_MAX_LEN {
+			add("password", "must be from %d to %d bytes long",
+				consts.VALIDATION_PASSWORD_MIN_LEN, consts.VALIDATION_PASSWORD_MAX_LEN)
+		}
+	}
+	return
+}
+
+// Check the first or last name, return the description of the violation
+func checkName(name string) string {
+	if !utf8.ValidString(name) {
+		return "must be the valid UTF-8 string"
+	}
+	if utf8.RuneCountInString(name) > consts.VALIDATION_NAME_MAX_LEN {
+		return fmt.Sprintf("must be at most %d characters long",
+			consts.VALIDATION_NAME_MAX_LEN)
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "must not contain control characters"
+		}
+	}
+	return ""
+}
+
+// Check the email is the plain address of RFC 5322 without the display name,
+// return the description of the violation
+func checkEmail(email string) string {
+	if len(email) > consts.VALIDATION_EMAIL_MAX_LEN {
+		return fmt.Sprintf("must be at most %d characters long",
+			consts.VALIDATION_EMAIL_MAX_LEN)
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != email {
+		return "must be the valid email address, e.g. \"user@example.com\""
+	}
+	at := strings.LastIndex(email, "@")
+	if at > consts.VALIDATION_EMAIL_LOCAL_MAX_LEN {
+		return fmt.Sprintf("the local part must be at most %d characters long",
+			consts.VALIDATION_EMAIL_LOCAL_MAX_LEN)
+	}
+	domain := email[at+1:]
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") ||
+		strings.HasSuffix(domain, ".") {
+		return "the domain must be the fully qualified domain name"
+	}
+	return ""
+}
@@ -0,0 +1,49 @@
+package validation
+
+import (
+	"api/consts"
+	validator_models "api/models/validator"
+	watcher_models "api/models/watcher"
+	webhook_models "api/models/webhook"
+	"api/util"
+	"fmt"
+	"net/url"
+)
+
+// WebhookValidator checks the fields of the webhook
+type WebhookValidator struct {
+	// the URL can have the private or the loopback host
+	AllowPrivateHosts bool
+}
+
+// Validate the webhook fields, return all violations
+func (v *WebhookValidator) Validate(
+	webhook *webhook_models.Webhook) (violations []validator_models.FieldViolation) {
+
+	add := func(field string, format string, a ...interface{}) {
+		violations = append(violations, validator_models.FieldViolation{
+			Field:       field,
+			Description: fmt.Sprintf(format, a...),
+		})
+	}
+
+	u, err := url.Parse(webhook.URL)
+	switch {
+	case err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https"):
+		add("url", "must be the absolute http or https URL")
+	case !v.AllowPrivateHosts && !util.PublicHost(u.Hostname()):
+		add("url", "must not have the private or the loopback host")
+	}
+	if len(webhook.Secret) < consts.WEBHOOK_SECRET_MIN_LEN {
+		add("secret", "must be at least %d characters long", consts.WEBHOOK_SECRET_MIN_LEN)
+	}
+	for _, t := range webhook.Events {
+		switch t {
+		case watcher_models.USER_ADDED, watcher_models.USER_MODIFIED,
+			watcher_models.USER_DELETED, watcher_models.USER_RESTORED:
+		default:
+			add("events", "unknown event type %q", t)
+		}
+	}
+	return violations
+}